@@ -16,16 +16,14 @@ limitations under the License.
 package cmd
 
 import (
-	"os"
-	"strings"
-
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/record"
-	"github.com/google/test-server/internal/redact"
 	"github.com/spf13/cobra"
 )
 
 var recordingDir string
+var recordReportFile string
+var recordReportFormat string
 
 var recordCmd = &cobra.Command{
 	Use:   "record",
@@ -38,13 +36,17 @@ target server, and all requests and responses will be recorded.`,
 			panic(err)
 		}
 
-		secrets := os.Getenv("TEST_SERVER_SECRETS")
-		redactor, err := redact.NewRedact(strings.Split(secrets, ","))
+		redactor, err := newRedactor(config)
+		if err != nil {
+			panic(err)
+		}
+
+		reporter, err := newReporter("record", recordReportFile, recordReportFormat)
 		if err != nil {
 			panic(err)
 		}
 
-		err = record.Record(config, recordingDir, redactor)
+		err = record.Record(config, recordingDir, redactor, reporter)
 		if err != nil {
 			panic(err)
 		}
@@ -54,4 +56,6 @@ target server, and all requests and responses will be recorded.`,
 func init() {
 	rootCmd.AddCommand(recordCmd)
 	recordCmd.Flags().StringVar(&recordingDir, "recording-dir", "recordings", "Directory to store recorded requests and responses")
+	recordCmd.Flags().StringVar(&recordReportFile, "report-file", "", "File to write a report of the session to on shutdown")
+	recordCmd.Flags().StringVar(&recordReportFormat, "report-format", "json", "Format of the report file, either json or junit")
 }
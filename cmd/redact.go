@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/rewrite"
+	"github.com/spf13/cobra"
+)
+
+var redactRecordingDir string
+var redactDryRun bool
+
+var redactCmd = &cobra.Command{
+	Use:   "redact",
+	Short: "Redact existing recordings in place",
+	Long: `Applies the current redaction config to the requests, responses and
+websocket logs of a recording directory, rewriting the files in place. The
+sha sums and previous request links of the recorded requests are recomputed
+so that the recordings keep matching in replay.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := config.ReadConfig(cfgFile)
+		if err != nil {
+			panic(err)
+		}
+
+		redactor, err := newRedactor(config)
+		if err != nil {
+			panic(err)
+		}
+
+		summary, err := rewrite.Rewrite(config, redactRecordingDir, redactor, redactDryRun)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, path := range summary.Changed {
+			if newPath, ok := summary.Renamed[path]; ok {
+				fmt.Printf("Redacted: %s -> %s\n", path, newPath)
+				continue
+			}
+			fmt.Printf("Redacted: %s\n", path)
+		}
+		fmt.Printf("Scanned %d files, redacted %d files, updated %d sha sums\n",
+			len(summary.Files), len(summary.Changed), summary.Interactions)
+		if redactDryRun {
+			fmt.Printf("Dry run, no file was written\n")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(redactCmd)
+	redactCmd.Flags().StringVar(&redactRecordingDir, "recording-dir", "recordings", "Directory containing recorded requests and responses")
+	redactCmd.Flags().BoolVar(&redactDryRun, "dry-run", false, "Print the changes without writing them")
+}
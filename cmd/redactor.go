@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/test-server/internal/authemu"
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/secrets"
+)
+
+// newRedactor creates the redactor shared by all endpoints, from the
+// TEST_SERVER_SECRETS environment variable, the redaction config section and
+// the upstream credentials of the endpoints.
+func newRedactor(cfg *config.TestServerConfig) (*redact.Redact, error) {
+	secretValues := strings.Split(os.Getenv("TEST_SERVER_SECRETS"), ",")
+	sourceValues, err := secrets.Resolve(cfg.Redaction.Secrets, cfg.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	secretValues = append(secretValues, sourceValues...)
+	// Upstream credentials are redacted too, even from responses without
+	// redact_responses, in case the target echoes them. They are optional here
+	// since only record mode requires them.
+	var credentialSources []config.SecretSource
+	for _, endpoint := range cfg.Endpoints {
+		for _, cred := range append(endpoint.UpstreamHeaders, endpoint.UpstreamQueryParams...) {
+			source := cred.Source
+			source.Optional = true
+			credentialSources = append(credentialSources, source)
+		}
+	}
+	credentialValues, err := secrets.Resolve(credentialSources, cfg.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	key := os.Getenv(cfg.Redaction.KeyEnv)
+	if cfg.Redaction.Replacement == redact.ReplacementHash && key == "" {
+		return nil, fmt.Errorf("redaction.key_env must name a non-empty environment variable for the %s replacement", redact.ReplacementHash)
+	}
+	return redact.New(redact.Options{
+		Secrets:     secretValues,
+		Credentials: credentialValues,
+		Patterns:    cfg.Redaction.Patterns,
+		Detectors:   cfg.Redaction.Detectors,
+		Replacement: cfg.Redaction.Replacement,
+		Key:         key,
+		// The fake tokens of auth emulators match the bearer_token and jwt
+		// detectors.
+		Allowed:         []string{authemu.AccessToken},
+		AllowedSuffixes: []string{authemu.IDTokenSuffix},
+	})
+}
@@ -17,16 +17,14 @@ limitations under the License.
 package cmd
 
 import (
-	"os"
-	"strings"
-
 	"github.com/google/test-server/internal/config"
-	"github.com/google/test-server/internal/redact"
 	"github.com/google/test-server/internal/replay"
 	"github.com/spf13/cobra"
 )
 
 var replayRecordingDir string
+var replayReportFile string
+var replayReportFormat string
 
 // replayCmd represents the replay command
 var replayCmd = &cobra.Command{
@@ -34,21 +32,25 @@ var replayCmd = &cobra.Command{
 	Short: "Replay recorded HTTP responses",
 	Long: `Replay mode serves recorded HTTP responses for matching requests.
 It listens on the configured source ports and returns recorded responses
-when it finds a matching request. Returns a 404 error if no matching
-recording is found.`,
+when it finds a matching request. Returns an internal server error if no
+matching recording is found, unless the endpoint configures on_miss.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		config, err := config.ReadConfig(cfgFile)
 		if err != nil {
 			panic(err)
 		}
 
-		secrets := os.Getenv("TEST_SERVER_SECRETS")
-		redactor, err := redact.NewRedact(strings.Split(secrets, ","))
+		redactor, err := newRedactor(config)
+		if err != nil {
+			panic(err)
+		}
+
+		reporter, err := newReporter("replay", replayReportFile, replayReportFormat)
 		if err != nil {
 			panic(err)
 		}
 
-		err = replay.Replay(config, replayRecordingDir, redactor)
+		err = replay.Replay(config, replayRecordingDir, redactor, reporter)
 		if err != nil {
 			panic(err)
 		}
@@ -58,4 +60,6 @@ recording is found.`,
 func init() {
 	rootCmd.AddCommand(replayCmd)
 	replayCmd.Flags().StringVar(&replayRecordingDir, "recording-dir", "recordings", "Directory containing recorded requests and responses")
+	replayCmd.Flags().StringVar(&replayReportFile, "report-file", "", "File to write a report of the session to on shutdown")
+	replayCmd.Flags().StringVar(&replayReportFormat, "report-format", "json", "Format of the report file, either json or junit")
 }
@@ -0,0 +1,51 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/test-server/internal/report"
+)
+
+// newReporter creates the report for the given mode. When reportFile is set,
+// the report is written to it once test-server receives SIGINT or SIGTERM.
+func newReporter(mode string, reportFile string, reportFormat string) (*report.Report, error) {
+	if reportFile == "" {
+		return nil, nil
+	}
+	if err := report.ValidateFormat(reportFormat); err != nil {
+		return nil, err
+	}
+
+	reporter := report.New(mode)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Printf("Writing %s report to: %s\n", reportFormat, reportFile)
+		if err := reporter.WriteFile(reportFile, reportFormat); err != nil {
+			fmt.Printf("Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+	return reporter, nil
+}
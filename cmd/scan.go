@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/scan"
+	"github.com/spf13/cobra"
+)
+
+var scanRecordingDir string
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Scan recordings for leaked secrets",
+	Long: `Scans the JSON recordings and websocket logs of a recording directory for
+suspected secrets, using the configured redaction rules and all the built-in
+credential detectors. Reports the file, JSON path and kind of every finding,
+and exits with a non-zero status when there is any.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := config.ReadConfig(cfgFile)
+		if err != nil {
+			panic(err)
+		}
+
+		// Scan with every detector, whether or not they are enabled for recording.
+		config.Redaction.Detectors = []string{redact.AllDetectors}
+		// Finding secrets does not replace them, so the replacement and its
+		// key, which CI may not have, do not matter.
+		config.Redaction.Replacement = redact.ReplacementConstant
+		redactor, err := newRedactor(config)
+		if err != nil {
+			panic(err)
+		}
+
+		findings, err := scan.Scan(config, scanRecordingDir, redactor)
+		if err != nil {
+			panic(err)
+		}
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if len(findings) > 0 {
+			fmt.Printf("Found %d suspected secrets in %s\n", len(findings), scanRecordingDir)
+			os.Exit(1)
+		}
+		fmt.Printf("No suspected secrets found in %s\n", scanRecordingDir)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scanCmd)
+	scanCmd.Flags().StringVar(&scanRecordingDir, "recording-dir", "recordings", "Directory containing recorded requests and responses")
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package authemu emulates the Google OAuth2 token endpoint and the GCP
+// metadata server, so that client libraries get well-formed but fake
+// credentials without any real account, in both record and replay mode.
+package authemu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+)
+
+const (
+	// AccessToken is the access token issued for every request. It is constant
+	// so that recorded requests carrying it keep matching in replay, and has no
+	// ya29. prefix so that it does not look like a real Google OAuth2 token.
+	AccessToken = "test-server-fake-access-token"
+
+	defaultProjectID        = "test-project"
+	numericProjectID        = "123456789012"
+	zone                    = "us-central1-a"
+	universeDomain          = "googleapis.com"
+	tokenLifetime           = time.Hour
+	metadataFlavorHeader    = "Metadata-Flavor"
+	metadataFlavor          = "Google"
+	metadataPrefix          = "/computeMetadata/v1/"
+	serviceAccountsPrefix   = metadataPrefix + "instance/service-accounts/"
+	cloudPlatformScope      = "https://www.googleapis.com/auth/cloud-platform"
+	tokenType               = "Bearer"
+	idTokenIssuer           = "https://accounts.google.com"
+	idTokenSignature        = "test-server-fake-signature"
+	defaultIDTokenAudience  = "test-server"
+	defaultServiceAccountID = "default"
+)
+
+// IDTokenSuffix ends every ID token issued by the emulator: the separator and
+// the fixed signature, which makes the tokens recognisable.
+var IDTokenSuffix = "." + base64.RawURLEncoding.EncodeToString([]byte(idTokenSignature))
+
+// idTokenIssuedAt and idTokenExpiry are the fixed issue and expiry times of ID
+// tokens, so that an audience always gets the same token and recorded
+// requests carrying it keep matching in replay.
+var (
+	idTokenIssuedAt = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	idTokenExpiry   = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Server serves fake tokens and metadata for an auth_emulator endpoint.
+type Server struct {
+	config    *config.EndpointConfig
+	projectID string
+	email     string
+}
+
+func NewServer(cfg *config.EndpointConfig) *Server {
+	projectID := cfg.AuthEmulator.ProjectID
+	if projectID == "" {
+		projectID = defaultProjectID
+	}
+	email := cfg.AuthEmulator.ServiceAccountEmail
+	if email == "" {
+		email = fmt.Sprintf("test-server@%s.iam.gserviceaccount.com", projectID)
+	}
+	return &Server{
+		config:    cfg,
+		projectID: projectID,
+		email:     email,
+	}
+}
+
+// Start serves the emulator on the source port, over TLS when the source type
+// is https, like the other endpoints.
+func (s *Server) Start() error {
+	fmt.Printf("Auth emulator listening on :%d\n", s.config.SourcePort)
+	return listen.ListenAndServe(s.config, s)
+}
+
+// ServeHTTP serves the OAuth2 token endpoint on /token and the metadata server
+// on / and /computeMetadata/v1/.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == s.config.Health {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch {
+	case req.URL.Path == "/token" || req.URL.Path == "/oauth2/v4/token":
+		s.serveToken(w, req)
+	case req.URL.Path == "/" || strings.HasPrefix(req.URL.Path, metadataPrefix):
+		s.serveMetadata(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveToken emulates oauth2.googleapis.com/token for every grant type. An ID
+// token is issued instead of an access token when a target_audience is
+// requested, as for service account ID tokens.
+func (s *Server) serveToken(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+	if audience := req.PostForm.Get("target_audience"); audience != "" {
+		writeJSON(w, http.StatusOK, map[string]any{"id_token": s.idToken(audience)})
+		return
+	}
+	resp := s.accessToken()
+	if scope := req.PostForm.Get("scope"); scope != "" {
+		resp["scope"] = scope
+	}
+	// Refresh token grants of user credentials also get an ID token.
+	if req.PostForm.Get("grant_type") == "refresh_token" {
+		resp["id_token"] = s.idToken(req.PostForm.Get("client_id"))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveMetadata emulates the paths of the GCP metadata server used by
+// Application Default Credentials.
+func (s *Server) serveMetadata(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(metadataFlavorHeader, metadataFlavor)
+	if req.URL.Path == "/" {
+		// ADC pings the root to detect the metadata server.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if req.Header.Get(metadataFlavorHeader) != metadataFlavor {
+		http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, metadataPrefix)
+	switch path {
+	case "project/project-id":
+		writeText(w, s.projectID)
+		return
+	case "project/numeric-project-id":
+		writeText(w, numericProjectID)
+		return
+	case "instance/zone":
+		writeText(w, fmt.Sprintf("projects/%s/zones/%s", numericProjectID, zone))
+		return
+	case "universe/universe-domain":
+		writeText(w, universeDomain)
+		return
+	case "instance/service-accounts/", "instance/service-accounts":
+		writeText(w, defaultServiceAccountID+"/\n"+s.email+"/\n")
+		return
+	}
+
+	account, attribute, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, serviceAccountsPrefix), "/")
+	if !ok || !strings.HasPrefix(req.URL.Path, serviceAccountsPrefix) || (account != defaultServiceAccountID && account != s.email) {
+		http.NotFound(w, req)
+		return
+	}
+	switch attribute {
+	case "":
+		if req.URL.Query().Get("recursive") == "true" {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"aliases": []string{defaultServiceAccountID},
+				"email":   s.email,
+				"scopes":  []string{cloudPlatformScope},
+			})
+			return
+		}
+		writeText(w, "aliases\nemail\nidentity\nscopes\ntoken\n")
+	case "email":
+		writeText(w, s.email)
+	case "aliases":
+		writeText(w, defaultServiceAccountID)
+	case "scopes":
+		writeText(w, cloudPlatformScope)
+	case "token":
+		writeJSON(w, http.StatusOK, s.accessToken())
+	case "identity":
+		audience := req.URL.Query().Get("audience")
+		if audience == "" {
+			http.Error(w, "non-empty audience parameter required", http.StatusBadRequest)
+			return
+		}
+		writeText(w, s.idToken(audience))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *Server) accessToken() map[string]any {
+	return map[string]any{
+		"access_token": AccessToken,
+		"expires_in":   int(tokenLifetime.Seconds()) - 1,
+		"token_type":   tokenType,
+	}
+}
+
+// idToken returns an unsigned but well-formed JWT for the given audience.
+func (s *Server) idToken(audience string) string {
+	if audience == "" {
+		audience = defaultIDTokenAudience
+	}
+	header := map[string]any{"alg": "RS256", "typ": "JWT", "kid": "test-server"}
+	claims := map[string]any{
+		"iss":            idTokenIssuer,
+		"aud":            audience,
+		"azp":            s.email,
+		"sub":            numericProjectID,
+		"email":          s.email,
+		"email_verified": true,
+		"iat":            idTokenIssuedAt.Unix(),
+		"exp":            idTokenExpiry.Unix(),
+	}
+	return encodeSegment(header) + "." + encodeSegment(claims) + IDTokenSuffix
+}
+
+func encodeSegment(v map[string]any) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error writing auth emulator response: %v\n", err)
+	}
+}
+
+func writeText(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte(text))
+}
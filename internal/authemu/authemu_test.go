@@ -0,0 +1,165 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authemu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ServeHTTP(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		form           url.Values
+		metadataFlavor bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Service account token",
+			method:         http.MethodPost,
+			path:           "/token",
+			form:           url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {"x"}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"access_token":"test-server-fake-access-token","expires_in":3599,"token_type":"Bearer"}` + "\n",
+		},
+		{
+			name:           "Token endpoint only accepts POST",
+			method:         http.MethodGet,
+			path:           "/token",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "Metadata server detection",
+			method:         http.MethodGet,
+			path:           "/",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Metadata requires the flavor header",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/project/project-id",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Metadata project id",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/project/project-id",
+			metadataFlavor: true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "my-project",
+		},
+		{
+			name:           "Metadata default service account token",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/instance/service-accounts/default/token",
+			metadataFlavor: true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"access_token":"test-server-fake-access-token","expires_in":3599,"token_type":"Bearer"}` + "\n",
+		},
+		{
+			name:           "Metadata service account email",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/instance/service-accounts/test-server@my-project.iam.gserviceaccount.com/email",
+			metadataFlavor: true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "test-server@my-project.iam.gserviceaccount.com",
+		},
+		{
+			name:           "Metadata unknown service account",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/instance/service-accounts/other/email",
+			metadataFlavor: true,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Metadata identity requires an audience",
+			method:         http.MethodGet,
+			path:           "/computeMetadata/v1/instance/service-accounts/default/identity",
+			metadataFlavor: true,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown path",
+			method:         http.MethodGet,
+			path:           "/unknown",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	server := NewServer(&config.EndpointConfig{AuthEmulator: config.AuthEmulatorConfig{ProjectID: "my-project"}})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.form.Encode()))
+			if tc.form != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tc.metadataFlavor {
+				req.Header.Set("Metadata-Flavor", "Google")
+			}
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, req)
+
+			require.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedBody != "" {
+				require.Equal(t, tc.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_IDToken(t *testing.T) {
+	server := NewServer(&config.EndpointConfig{})
+
+	req := httptest.NewRequest(http.MethodGet, "/computeMetadata/v1/instance/service-accounts/default/identity?audience=https://example.com", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.True(t, strings.HasSuffix(w.Body.String(), IDTokenSuffix))
+	segments := strings.Split(w.Body.String(), ".")
+	require.Len(t, segments, 3)
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	require.Equal(t, "https://example.com", claims["aud"])
+	require.Equal(t, "test-server@test-project.iam.gserviceaccount.com", claims["email"])
+	require.Equal(t, float64(1704067200), claims["iat"])
+	require.Equal(t, float64(4102444800), claims["exp"])
+
+	// The token is the same on every request.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	require.Equal(t, strings.Join(segments, "."), w.Body.String())
+}
+
+func TestServer_StartRequiresTLSForHTTPS(t *testing.T) {
+	server := NewServer(&config.EndpointConfig{Type: config.EndpointTypeAuthEmulator, SourceType: "https"})
+	require.ErrorContains(t, server.Start(), "source_tls.cert_file and source_tls.key_file are required")
+}
@@ -18,20 +18,89 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
+	"github.com/google/test-server/internal/jsonpath"
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
 )
 
+// Endpoint types, the default empty type proxies to or replays the target.
+const (
+	// EndpointTypeAuthEmulator serves fake OAuth2 tokens and GCP metadata
+	// server responses, in both record and replay mode.
+	EndpointTypeAuthEmulator = "auth_emulator"
+	// EndpointTypeGRPC proxies to or replays gRPC calls over HTTP/2.
+	EndpointTypeGRPC = "grpc"
+)
+
 type EndpointConfig struct {
-	TargetType                 string              `yaml:"target_type"`
-	TargetHost                 string              `yaml:"target_host"`
-	TargetPort                 int64               `yaml:"target_port"`
-	SourcePort                 int64               `yaml:"source_port"`
-	SourceType                 string              `yaml:"source_type"`
-	Health                     string              `yaml:"health"`
-	RedactRequestHeaders       []string            `yaml:"redact_request_headers"`
-	ResponseHeaderReplacements []HeaderReplacement `yaml:"response_header_replacements"`
+	Type                       string               `yaml:"type"`
+	TargetType                 string               `yaml:"target_type"`
+	TargetHost                 string               `yaml:"target_host"`
+	TargetPort                 int64                `yaml:"target_port"`
+	SourcePort                 int64                `yaml:"source_port"`
+	SourceType                 string               `yaml:"source_type"`
+	SourceTLS                  TLSConfig            `yaml:"source_tls"`
+	Health                     string               `yaml:"health"`
+	RedactRequestHeaders       []string             `yaml:"redact_request_headers"`
+	RecordRequestHeaders       []string             `yaml:"record_request_headers"`
+	RecordResponseHeaders      []string             `yaml:"record_response_headers"`
+	RedactQueryParams          []string             `yaml:"redact_query_params"`
+	ResponseHeaderReplacements []HeaderReplacement  `yaml:"response_header_replacements"`
+	UpstreamHeaders            []UpstreamCredential `yaml:"upstream_headers"`
+	UpstreamQueryParams        []UpstreamCredential `yaml:"upstream_query_params"`
+	RedactResponseHeaders      []string             `yaml:"redact_response_headers"`
+	RedactResponses            bool                 `yaml:"redact_responses"`
+	RedactJSONPaths            []jsonpath.Path      `yaml:"redact_json_paths"`
+	WebsocketIgnorePaths       []jsonpath.Path      `yaml:"websocket_ignore_paths"`
+	WebsocketReplayTiming      bool                 `yaml:"websocket_replay_timing"`
+	WebsocketTargetType        string               `yaml:"websocket_target_type"`
+	WebsocketIdleTimeout       time.Duration        `yaml:"websocket_idle_timeout"`
+	RecordWebsocketPings       bool                 `yaml:"record_websocket_pings"`
+	ProtoDescriptorSet         string               `yaml:"proto_descriptor_set"`
+	ProtoMessages              []ProtoMessage       `yaml:"proto_messages"`
+	SendStatusText             bool                 `yaml:"send_status_text"`
+	OnMiss                     MissConfig           `yaml:"on_miss"`
+	AuthEmulator               AuthEmulatorConfig   `yaml:"auth_emulator"`
+}
+
+// WebsocketScheme returns the scheme websocket connections are proxied to the
+// target with: websocket_target_type when set, and otherwise ws for an http
+// target and wss for any other target.
+func (c *EndpointConfig) WebsocketScheme() string {
+	if c.WebsocketTargetType != "" {
+		return c.WebsocketTargetType
+	}
+	if c.TargetType == "http" {
+		return "ws"
+	}
+	return "wss"
+}
+
+// validate rejects the values the endpoint settings do not accept, which would
+// otherwise silently fall back to another behaviour or fail on first use.
+func (c *EndpointConfig) validate() error {
+	switch c.Type {
+	case "", EndpointTypeAuthEmulator, EndpointTypeGRPC:
+	default:
+		return fmt.Errorf("unknown type %q, expected %s or %s", c.Type, EndpointTypeAuthEmulator, EndpointTypeGRPC)
+	}
+	switch c.WebsocketTargetType {
+	case "", "ws", "wss":
+	default:
+		return fmt.Errorf("unknown websocket_target_type %q, expected ws or wss", c.WebsocketTargetType)
+	}
+	switch c.OnMiss.Format {
+	case "", "text", "google":
+	default:
+		return fmt.Errorf("unknown on_miss.format %q, expected text or google", c.OnMiss.Format)
+	}
+	if code := c.OnMiss.StatusCode; code != 0 && (code < 100 || code > 599) {
+		return fmt.Errorf("invalid on_miss.status_code %d, expected 100 to 599", code)
+	}
+	return nil
 }
 
 type HeaderReplacement struct {
@@ -40,8 +109,119 @@ type HeaderReplacement struct {
 	Replace string `yaml:"replace"`
 }
 
+// TLSConfig holds the certificate served by an https source port.
+type TLSConfig struct {
+	// CertFile and KeyFile are the paths of the PEM encoded certificate chain
+	// and private key, relative to the directory of the config file.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// ProtoMessage maps the URL paths matching Path to the protobuf message types
+// of their request and response bodies, which are then recorded as JSON.
+type ProtoMessage struct {
+	// Path is a URL path or gRPC method, which may contain path.Match patterns,
+	// for example /v1/projects/*/topics/*:publish.
+	Path string `yaml:"path"`
+	// Request and Response are full message names, for example
+	// google.pubsub.v1.PublishRequest.
+	Request  string `yaml:"request"`
+	Response string `yaml:"response"`
+}
+
+// UpstreamCredential is a header or query parameter that record mode adds to
+// the requests it forwards to the target, so clients never hold the secret.
+type UpstreamCredential struct {
+	// Name is the name of the header or query parameter.
+	Name string `yaml:"name"`
+	// Prefix is prepended to the secret value, for example "Bearer ".
+	Prefix string `yaml:"prefix"`
+	// The source of the secret value, the first value it resolves to is used.
+	Source SecretSource `yaml:",inline"`
+}
+
+// AuthEmulatorConfig configures the identity reported by an auth_emulator endpoint.
+type AuthEmulatorConfig struct {
+	// ProjectID is the project reported by the metadata server, "test-project"
+	// when unset.
+	ProjectID string `yaml:"project_id"`
+	// ServiceAccountEmail is the email of the default service account, derived
+	// from the project when unset.
+	ServiceAccountEmail string `yaml:"service_account_email"`
+}
+
+// MissConfig controls the response replay sends when no recording matches a request.
+type MissConfig struct {
+	// StatusCode is the HTTP status of the response, 500 when unset.
+	StatusCode int `yaml:"status_code"`
+	// Format is the body format, either "text" (the default) or "google" for a
+	// Google API {"error": {...}} envelope.
+	Format string `yaml:"format"`
+	// Message replaces the default error message when set.
+	Message string `yaml:"message"`
+}
+
+// RedactionConfig configures the secrets redacted from recordings, in addition
+// to the ones listed in the TEST_SERVER_SECRETS environment variable.
+type RedactionConfig struct {
+	// Patterns are regular expressions of values to redact. When a pattern has a
+	// capture group named "secret" only that group is redacted.
+	Patterns []string `yaml:"patterns"`
+	// Detectors are names of built-in detectors for common credential formats,
+	// or "all" to enable all of them.
+	Detectors []string `yaml:"detectors"`
+	// Replacement is the value secrets are replaced with: "constant" (the
+	// default) for REDACTED, "numbered" for REDACTED_<n> placeholders of the
+	// listed secrets or "hash" for REDACTED_<hash> placeholders that are stable
+	// across runs.
+	Replacement string `yaml:"replacement"`
+	// KeyEnv names the environment variable holding the HMAC key of the "hash"
+	// replacement, which is required.
+	KeyEnv string `yaml:"key_env"`
+	// Secrets are sources of literal secret values to redact.
+	Secrets []SecretSource `yaml:"secrets"`
+}
+
+// SecretSource is a source of secret values. Exactly one of Env, File and
+// Dotenv should be set.
+type SecretSource struct {
+	// Env is the name of an environment variable holding a secret.
+	Env string `yaml:"env"`
+	// File is the path of a file holding one secret per line.
+	File string `yaml:"file"`
+	// Dotenv is the path of a dotenv file of KEY=VALUE lines.
+	Dotenv string `yaml:"dotenv"`
+	// Keys are the keys of the dotenv file holding secrets, all of them when empty.
+	Keys []string `yaml:"keys"`
+	// Optional ignores a missing File or Dotenv.
+	Optional bool `yaml:"optional"`
+}
+
 type TestServerConfig struct {
 	Endpoints []EndpointConfig `yaml:"endpoints"`
+	Redaction RedactionConfig  `yaml:"redaction"`
+	// BaseDir is the directory of the config file, that relative paths in
+	// the config are resolved against.
+	BaseDir string `yaml:"-"`
+}
+
+// FindEndpoint returns the endpoint proxying to the given target, or nil when
+// there is none.
+func (c *TestServerConfig) FindEndpoint(targetHost string, targetPort int64) *EndpointConfig {
+	for i, endpoint := range c.Endpoints {
+		if endpoint.TargetHost == targetHost && endpoint.TargetPort == targetPort {
+			return &c.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// resolvePath resolves a relative path of the config against BaseDir.
+func (c *TestServerConfig) resolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.BaseDir, path)
 }
 
 func ReadConfig(filename string) (*TestServerConfig, error) {
@@ -54,11 +234,20 @@ func ReadConfigWithFs(fs afero.Fs, filename string) (*TestServerConfig, error) {
 		return nil, err
 	}
 
-	config := &TestServerConfig{}
+	config := &TestServerConfig{BaseDir: filepath.Dir(filename)}
 	err = yaml.Unmarshal(buf, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed parsing %s: %w", filename, err)
 	}
+	for i := range config.Endpoints {
+		tls := &config.Endpoints[i].SourceTLS
+		tls.CertFile = config.resolvePath(tls.CertFile)
+		tls.KeyFile = config.resolvePath(tls.KeyFile)
+		config.Endpoints[i].ProtoDescriptorSet = config.resolvePath(config.Endpoints[i].ProtoDescriptorSet)
+		if err := config.Endpoints[i].validate(); err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %w", filename, err)
+		}
+	}
 
 	return config, nil
 }
@@ -18,7 +18,9 @@ package config
 
 import (
 	"testing"
+	"time"
 
+	"github.com/google/test-server/internal/jsonpath"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -41,6 +43,7 @@ func TestReadConfigWithFs(t *testing.T) {
     target_type: https
     redact_request_headers:
       - X-Goog-Api-Key
+    send_status_text: true
   - target_host: api.example.com
     target_port: 8080
     source_port: 8081
@@ -49,6 +52,7 @@ func TestReadConfigWithFs(t *testing.T) {
 			filePath: "/test-config.yaml",
 			wantErr:  false,
 			wantConfig: &TestServerConfig{
+				BaseDir: "/",
 				Endpoints: []EndpointConfig{
 					{
 						TargetHost:           "www.google.com",
@@ -57,6 +61,7 @@ func TestReadConfigWithFs(t *testing.T) {
 						SourceType:           "http",
 						TargetType:           "https",
 						RedactRequestHeaders: []string{"X-Goog-Api-Key"},
+						SendStatusText:       true,
 					},
 					{
 						TargetHost: "api.example.com",
@@ -68,6 +73,218 @@ func TestReadConfigWithFs(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "config with on_miss",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    target_port: 443
+    source_port: 1443
+    source_type: http
+    target_type: https
+    on_miss:
+      status_code: 404
+      format: google
+      message: no recording found`,
+			filePath: "/on-miss-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir: "/",
+				Endpoints: []EndpointConfig{
+					{
+						TargetHost: "generativelanguage.googleapis.com",
+						TargetPort: 443,
+						SourcePort: 1443,
+						SourceType: "http",
+						TargetType: "https",
+						OnMiss: MissConfig{
+							StatusCode: 404,
+							Format:     "google",
+							Message:    "no recording found",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "config with auth emulator",
+			fileContent: `endpoints:
+  - type: auth_emulator
+    source_port: 1444
+    auth_emulator:
+      project_id: my-project`,
+			filePath: "/auth-emulator-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir: "/",
+				Endpoints: []EndpointConfig{
+					{
+						Type:         EndpointTypeAuthEmulator,
+						SourcePort:   1444,
+						AuthEmulator: AuthEmulatorConfig{ProjectID: "my-project"},
+					},
+				},
+			},
+		},
+		{
+			name: "config with grpc endpoint",
+			fileContent: `endpoints:
+  - type: grpc
+    target_host: pubsub.googleapis.com
+    target_port: 443
+    target_type: https
+    source_port: 1445
+    source_type: https
+    source_tls:
+      cert_file: certs/server.crt
+      key_file: /etc/server.key
+    proto_descriptor_set: protos/pubsub.pb
+    proto_messages:
+      - path: /v1/projects/*/topics/*:publish
+        request: google.pubsub.v1.PublishRequest
+        response: google.pubsub.v1.PublishResponse`,
+			filePath: "/config/grpc-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir: "/config",
+				Endpoints: []EndpointConfig{
+					{
+						Type:               EndpointTypeGRPC,
+						TargetHost:         "pubsub.googleapis.com",
+						TargetPort:         443,
+						TargetType:         "https",
+						SourcePort:         1445,
+						SourceType:         "https",
+						SourceTLS:          TLSConfig{CertFile: "/config/certs/server.crt", KeyFile: "/etc/server.key"},
+						ProtoDescriptorSet: "/config/protos/pubsub.pb",
+						ProtoMessages: []ProtoMessage{{
+							Path:     "/v1/projects/*/topics/*:publish",
+							Request:  "google.pubsub.v1.PublishRequest",
+							Response: "google.pubsub.v1.PublishResponse",
+						}},
+					},
+				},
+			},
+		},
+		{
+			name: "config with websocket settings",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    websocket_ignore_paths:
+      - sessionId
+    websocket_replay_timing: true
+    websocket_idle_timeout: 30s
+    record_websocket_pings: true`,
+			filePath: "/websocket-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir: "/",
+				Endpoints: []EndpointConfig{
+					{
+						TargetHost:            "generativelanguage.googleapis.com",
+						WebsocketIgnorePaths:  jsonpath.MustParseAll("sessionId"),
+						WebsocketReplayTiming: true,
+						WebsocketIdleTimeout:  30 * time.Second,
+						RecordWebsocketPings:  true,
+					},
+				},
+			},
+		},
+		{
+			name: "config with redaction",
+			fileContent: `endpoints: []
+redaction:
+  patterns:
+    - "AIza[0-9A-Za-z_-]{35}"
+  detectors:
+    - jwt
+    - bearer_token`,
+			filePath: "/redaction-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir:   "/",
+				Endpoints: []EndpointConfig{},
+				Redaction: RedactionConfig{
+					Patterns:  []string{"AIza[0-9A-Za-z_-]{35}"},
+					Detectors: []string{"jwt", "bearer_token"},
+				},
+			},
+		},
+		{
+			name: "config with redact_json_paths",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    redact_json_paths:
+      - contents[*].parts[*].text`,
+			filePath: "/redact-json-paths-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				BaseDir: "/",
+				Endpoints: []EndpointConfig{
+					{
+						TargetHost:      "generativelanguage.googleapis.com",
+						RedactJSONPaths: jsonpath.MustParseAll("contents[*].parts[*].text"),
+					},
+				},
+			},
+		},
+		{
+			name: "invalid redact_json_paths",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    redact_json_paths:
+      - contents[`,
+			filePath:   "/invalid-redact-json-paths-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
+		{
+			name: "invalid websocket_ignore_paths",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    websocket_ignore_paths:
+      - turns[x]`,
+			filePath:   "/invalid-websocket-ignore-paths-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
+		{
+			name: "unknown on_miss format",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    on_miss:
+      format: json`,
+			filePath:   "/invalid-on-miss-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
+		{
+			name: "invalid on_miss status code",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    on_miss:
+      status_code: 42`,
+			filePath:   "/invalid-on-miss-status-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
+		{
+			name: "unknown endpoint type",
+			fileContent: `endpoints:
+  - type: grcp
+    target_host: pubsub.googleapis.com`,
+			filePath:   "/invalid-type-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
+		{
+			name: "unknown websocket_target_type",
+			fileContent: `endpoints:
+  - target_host: generativelanguage.googleapis.com
+    websocket_target_type: http`,
+			filePath:   "/invalid-websocket-target-type-config.yaml",
+			wantErr:    true,
+			wantConfig: nil,
+		},
 		{
 			name:        "non-existent file",
 			fileContent: "",
@@ -117,3 +334,34 @@ func TestReadConfigWithFs(t *testing.T) {
 		})
 	}
 }
+
+func TestTestServerConfig_FindEndpoint(t *testing.T) {
+	cfg := &TestServerConfig{
+		Endpoints: []EndpointConfig{
+			{TargetHost: "www.google.com", TargetPort: 443, SourcePort: 1443},
+			{TargetHost: "api.example.com", TargetPort: 8080, SourcePort: 8081},
+		},
+	}
+
+	assert.Equal(t, &cfg.Endpoints[1], cfg.FindEndpoint("api.example.com", 8080))
+	assert.Nil(t, cfg.FindEndpoint("api.example.com", 443))
+}
+
+func TestEndpointConfig_WebsocketScheme(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   EndpointConfig
+		expected string
+	}{
+		{name: "https target", config: EndpointConfig{TargetType: "https"}, expected: "wss"},
+		{name: "http target", config: EndpointConfig{TargetType: "http"}, expected: "ws"},
+		{name: "No target type", config: EndpointConfig{}, expected: "wss"},
+		{name: "Explicit websocket target type", config: EndpointConfig{TargetType: "https", WebsocketTargetType: "ws"}, expected: "ws"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.config.WebsocketScheme())
+		})
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonpath implements a small path syntax to address values in
+// decoded JSON documents, such as "contents[*].parts[0].text" or "user.*".
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const wildcard = "*"
+
+// segment is a single step of a path, either an object key or an array index.
+type segment struct {
+	key   string
+	index int
+	array bool
+}
+
+// Path addresses values in a decoded JSON document. Keys are separated by
+// dots, array elements are addressed with [n], and * or [*] match every key or
+// array element.
+type Path struct {
+	raw      string
+	segments []segment
+}
+
+// Parse parses a path such as "contents[*].parts[0].text".
+func Parse(path string) (Path, error) {
+	p := Path{raw: path}
+	if path == "" {
+		return p, fmt.Errorf("empty json path")
+	}
+	for _, part := range strings.Split(path, ".") {
+		key, rest, bracket := strings.Cut(part, "[")
+		if key == "" && !bracket {
+			return p, fmt.Errorf("invalid json path %q: empty key", path)
+		}
+		if key != "" {
+			p.segments = append(p.segments, segment{key: key})
+		}
+		for bracket {
+			index, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return p, fmt.Errorf("invalid json path %q: missing ]", path)
+			}
+			if index == wildcard {
+				p.segments = append(p.segments, segment{key: wildcard, array: true})
+			} else {
+				n, err := strconv.Atoi(index)
+				if err != nil || n < 0 {
+					return p, fmt.Errorf("invalid json path %q: invalid index %q", path, index)
+				}
+				p.segments = append(p.segments, segment{index: n, array: true})
+			}
+			if after == "" {
+				break
+			}
+			if !strings.HasPrefix(after, "[") {
+				return p, fmt.Errorf("invalid json path %q: unexpected %q", path, after)
+			}
+			rest = after[1:]
+		}
+	}
+	return p, nil
+}
+
+// ParseAll parses all the given paths.
+func ParseAll(paths []string) ([]Path, error) {
+	parsed := make([]Path, 0, len(paths))
+	for _, path := range paths {
+		p, err := Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// MustParseAll is like ParseAll but panics if a path cannot be parsed.
+func MustParseAll(paths ...string) []Path {
+	parsed, err := ParseAll(paths)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// UnmarshalYAML parses a path of a YAML document.
+func (p *Path) UnmarshalYAML(unmarshal func(any) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	parsed, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// String returns the path as it was parsed.
+func (p Path) String() string {
+	return p.raw
+}
+
+// Replace calls fn for every value of doc addressed by the path, and replaces
+// the value with the result. Objects and arrays are modified in place.
+func (p Path) Replace(doc any, fn func(value any) any) {
+	replace(doc, p.segments, fn)
+}
+
+// Delete removes the object keys of doc addressed by the path. Addressed array
+// elements are set to null instead, so that the other elements keep their index.
+func (p Path) Delete(doc any) {
+	if len(p.segments) == 0 {
+		return
+	}
+	last := p.segments[len(p.segments)-1]
+	parent := Path{segments: p.segments[:len(p.segments)-1]}
+	deleteKey := func(node any) {
+		object, ok := node.(map[string]any)
+		if !ok || last.array {
+			return
+		}
+		for key := range object {
+			if last.key == wildcard || last.key == key {
+				delete(object, key)
+			}
+		}
+	}
+	if len(parent.segments) == 0 {
+		deleteKey(doc)
+	} else {
+		parent.Replace(doc, func(value any) any {
+			deleteKey(value)
+			return value
+		})
+	}
+	p.Replace(doc, func(any) any { return nil })
+}
+
+func replace(doc any, segments []segment, fn func(value any) any) {
+	if len(segments) == 0 {
+		return
+	}
+	seg, rest := segments[0], segments[1:]
+	switch node := doc.(type) {
+	case map[string]any:
+		if seg.array {
+			return
+		}
+		for key, value := range node {
+			if seg.key != wildcard && seg.key != key {
+				continue
+			}
+			if len(rest) == 0 {
+				node[key] = fn(value)
+			} else {
+				replace(value, rest, fn)
+			}
+		}
+	case []any:
+		if !seg.array && seg.key != wildcard {
+			return
+		}
+		for i, value := range node {
+			if seg.key != wildcard && seg.index != i {
+				continue
+			}
+			if len(rest) == 0 {
+				node[i] = fn(value)
+			} else {
+				replace(value, rest, fn)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_Errors(t *testing.T) {
+	for _, path := range []string{"", "a..b", "a[", "a[0", "a[x]", "a[-1]", "a[0]b"} {
+		t.Run(path, func(t *testing.T) {
+			_, err := Parse(path)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestPath_Replace(t *testing.T) {
+	doc := `{
+  "user": {"email": "a@example.com", "age": 30},
+  "contents": [
+    {"parts": [{"text": "first"}, {"text": "second"}]},
+    {"parts": [{"text": "third"}]}
+  ],
+  "matrix": [[1, 2], [3, 4]]
+}`
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "Object key",
+			path:     "user.email",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]},{"parts":[{"text":"third"}]}],"matrix":[[1,2],[3,4]],"user":{"age":30,"email":"X"}}`,
+		},
+		{
+			name:     "Wildcard key",
+			path:     "user.*",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]},{"parts":[{"text":"third"}]}],"matrix":[[1,2],[3,4]],"user":{"age":"X","email":"X"}}`,
+		},
+		{
+			name:     "Wildcard index",
+			path:     "contents[*].parts[*].text",
+			expected: `{"contents":[{"parts":[{"text":"X"},{"text":"X"}]},{"parts":[{"text":"X"}]}],"matrix":[[1,2],[3,4]],"user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Index",
+			path:     "contents[0].parts[1].text",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"X"}]},{"parts":[{"text":"third"}]}],"matrix":[[1,2],[3,4]],"user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Nested index",
+			path:     "matrix[1][0]",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]},{"parts":[{"text":"third"}]}],"matrix":[[1,2],["X",4]],"user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Missing path",
+			path:     "user.phone",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]},{"parts":[{"text":"third"}]}],"matrix":[[1,2],[3,4]],"user":{"age":30,"email":"a@example.com"}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var input map[string]any
+			require.NoError(t, json.Unmarshal([]byte(doc), &input))
+			path, err := Parse(tc.path)
+			require.NoError(t, err)
+			require.Equal(t, tc.path, path.String())
+
+			path.Replace(input, func(any) any { return "X" })
+			actual, err := json.Marshal(input)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(actual))
+		})
+	}
+}
+
+func TestPath_Delete(t *testing.T) {
+	const doc = `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]}],"id":"a","user":{"age":30,"email":"a@example.com"}}`
+	testCases := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "Top-level key",
+			path:     "id",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]}],"user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Wildcard key",
+			path:     "user.*",
+			expected: `{"contents":[{"parts":[{"text":"first"},{"text":"second"}]}],"id":"a","user":{}}`,
+		},
+		{
+			name:     "Key in array elements",
+			path:     "contents[*].parts[*].text",
+			expected: `{"contents":[{"parts":[{},{}]}],"id":"a","user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Array element",
+			path:     "contents[0].parts[0]",
+			expected: `{"contents":[{"parts":[null,{"text":"second"}]}],"id":"a","user":{"age":30,"email":"a@example.com"}}`,
+		},
+		{
+			name:     "Missing path",
+			path:     "user.phone",
+			expected: doc,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var input map[string]any
+			require.NoError(t, json.Unmarshal([]byte(doc), &input))
+			path, err := Parse(tc.path)
+			require.NoError(t, err)
+
+			path.Delete(input)
+			actual, err := json.Marshal(input)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(actual))
+		})
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package listen serves the source ports of endpoints over HTTP/1.1 and
+// HTTP/2.
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Handler wraps handler to also serve HTTP/2 without TLS, for clients with
+// prior knowledge of HTTP/2 or upgrading with h2c.
+func Handler(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// ListenAndServe serves handler on the source port of the endpoint. When the
+// source type is https, it serves TLS with the source_tls certificate and
+// negotiates HTTP/2 with ALPN, otherwise it serves h2c.
+func ListenAndServe(cfg *config.EndpointConfig, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.SourcePort),
+		Handler: handler,
+	}
+	if cfg.SourceType != "https" {
+		server.Handler = Handler(handler)
+		return server.ListenAndServe()
+	}
+	if cfg.SourceTLS.CertFile == "" || cfg.SourceTLS.KeyFile == "" {
+		return fmt.Errorf("source_tls.cert_file and source_tls.key_file are required for an https source")
+	}
+	return server.ListenAndServeTLS(cfg.SourceTLS.CertFile, cfg.SourceTLS.KeyFile)
+}
+
+// connectionHeaders are the hop-by-hop headers of HTTP/1.1, which HTTP/2
+// responses must not carry.
+var connectionHeaders = map[string]struct{}{
+	"Connection":        {},
+	"Keep-Alive":        {},
+	"Proxy-Connection":  {},
+	"Transfer-Encoding": {},
+	"Upgrade":           {},
+}
+
+// IsConnectionHeader reports whether name is a hop-by-hop header, which the
+// server sets itself and must not be copied to responses.
+func IsConnectionHeader(name string) bool {
+	_, ok := connectionHeaders[http.CanonicalHeaderKey(name)]
+	return ok
+}
+
+// WriteResponse writes a response with the headers of w, then body and
+// trailer, which are declared in the Trailer header. net/http only writes the
+// standard reason phrases and HTTP/2 has none, so a non-standard statusText is
+// only sent to HTTP/1.x clients, by writing the response on the hijacked
+// connection, which is then closed. Callers only pass a statusText when the
+// endpoint opted in with send_status_text.
+func WriteResponse(w http.ResponseWriter, req *http.Request, statusCode int, statusText string, body []byte, trailer http.Header) error {
+	if statusText == "" || statusText == http.StatusText(statusCode) || req.ProtoMajor != 1 {
+		return writeResponse(w, statusCode, body, trailer)
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		return writeResponse(w, statusCode, body, trailer)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	header := w.Header().Clone()
+	for name := range header {
+		if IsConnectionHeader(name) {
+			header.Del(name)
+		}
+	}
+	header.Set("Connection", "close")
+	bodyAllowed := statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified && req.Method != http.MethodHead
+	chunked := bodyAllowed && len(trailer) > 0
+	switch {
+	case chunked:
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		header.Set("Trailer", trailerNames(trailer))
+	case bodyAllowed:
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", statusCode, statusText)
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	switch {
+	case chunked:
+		if len(body) > 0 {
+			fmt.Fprintf(buf, "%x\r\n", len(body))
+			buf.Write(body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("0\r\n")
+		trailer.Write(buf)
+		buf.WriteString("\r\n")
+	case bodyAllowed:
+		buf.Write(body)
+	}
+	return buf.Flush()
+}
+
+func writeResponse(w http.ResponseWriter, statusCode int, body []byte, trailer http.Header) error {
+	if len(trailer) > 0 {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Trailer", trailerNames(trailer))
+	}
+	w.WriteHeader(statusCode)
+	if len(body) > 0 {
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+	}
+	for name, values := range trailer {
+		w.Header()[name] = values
+	}
+	return nil
+}
+
+// trailerNames returns the value of the Trailer header declaring trailer.
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
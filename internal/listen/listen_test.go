@@ -0,0 +1,198 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listen
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 1, resp.ProtoMajor, "HTTP/1.1 should still be served")
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 2, resp.ProtoMajor, "HTTP/2 with prior knowledge should be served")
+}
+
+func TestListenAndServe_MissingCertificate(t *testing.T) {
+	cfg := &config.EndpointConfig{SourceType: "https", SourcePort: 0}
+	err := ListenAndServe(cfg, http.NotFoundHandler())
+	require.ErrorContains(t, err, "source_tls.cert_file and source_tls.key_file are required")
+}
+
+func TestWriteResponse(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		trailer := http.Header{}
+		if req.URL.Query().Get("trailer") != "" {
+			trailer.Set("X-Checksum", "abc")
+		}
+		err := WriteResponse(w, req, 429, req.URL.Query().Get("status"), []byte("slow down"), trailer)
+		require.NoError(t, err)
+	})))
+	defer server.Close()
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+
+	testCases := []struct {
+		name             string
+		client           *http.Client
+		query            string
+		expectedStatus   string
+		expectedTrailers http.Header
+	}{
+		{
+			name:           "HTTP/1.1 standard status text",
+			client:         http.DefaultClient,
+			expectedStatus: "429 Too Many Requests",
+		},
+		{
+			name:           "HTTP/1.1 custom status text",
+			client:         http.DefaultClient,
+			query:          "?status=Slow+Down",
+			expectedStatus: "429 Slow Down",
+		},
+		{
+			name:             "HTTP/1.1 custom status text and trailers",
+			client:           http.DefaultClient,
+			query:            "?status=Slow+Down&trailer=1",
+			expectedStatus:   "429 Slow Down",
+			expectedTrailers: http.Header{"X-Checksum": {"abc"}},
+		},
+		{
+			name:             "HTTP/1.1 trailers",
+			client:           http.DefaultClient,
+			query:            "?trailer=1",
+			expectedStatus:   "429 Too Many Requests",
+			expectedTrailers: http.Header{"X-Checksum": {"abc"}},
+		},
+		{
+			name:             "HTTP/2 drops the custom status text",
+			client:           h2cClient,
+			query:            "?status=Slow+Down&trailer=1",
+			expectedStatus:   "429 Too Many Requests",
+			expectedTrailers: http.Header{"X-Checksum": {"abc"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := tc.client.Get(server.URL + tc.query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "slow down", string(body))
+			require.Equal(t, tc.expectedStatus, resp.Status)
+			require.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+			if tc.expectedTrailers == nil {
+				require.Empty(t, resp.Trailer)
+			} else {
+				require.Equal(t, tc.expectedTrailers, resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestWriteResponse_KeepAlive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := WriteResponse(w, req, 429, req.URL.Query().Get("status"), []byte("slow down"), nil)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus string
+		expectedReused bool
+	}{
+		{
+			name:           "Standard status text keeps the connection",
+			expectedStatus: "429 Too Many Requests",
+			expectedReused: true,
+		},
+		{
+			name:           "Custom status text closes the connection",
+			query:          "?status=Slow+Down",
+			expectedStatus: "429 Slow Down",
+			expectedReused: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &http.Transport{}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport}
+			var reused []bool
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			}}
+			for range 2 {
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", server.URL+tc.query, nil)
+				require.NoError(t, err)
+				resp, err := client.Do(req)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(t, err)
+				require.Equal(t, "slow down", string(body))
+				require.Equal(t, tc.expectedStatus, resp.Status)
+			}
+			require.Equal(t, []bool{false, tc.expectedReused}, reused)
+		})
+	}
+}
+
+func TestIsConnectionHeader(t *testing.T) {
+	require.True(t, IsConnectionHeader("connection"))
+	require.True(t, IsConnectionHeader("Transfer-Encoding"))
+	require.False(t, IsConnectionHeader("Content-Type"))
+}
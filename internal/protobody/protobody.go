@@ -0,0 +1,181 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package protobody converts protobuf bodies and gRPC messages to and from
+// JSON, with the message types of a descriptor set, so that recordings are
+// readable.
+package protobody
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Codec converts the bodies of an endpoint. A nil *Codec is valid and has no
+// message types.
+type Codec struct {
+	files    *protoregistry.Files
+	messages []config.ProtoMessage
+}
+
+// New loads the descriptor set of the endpoint, or returns nil when it has
+// none. The message types of proto_messages must be in the descriptor set.
+func New(cfg *config.EndpointConfig) (*Codec, error) {
+	if cfg.ProtoDescriptorSet == "" {
+		if len(cfg.ProtoMessages) > 0 {
+			return nil, fmt.Errorf("proto_messages requires a proto_descriptor_set")
+		}
+		return nil, nil
+	}
+	buf, err := os.ReadFile(cfg.ProtoDescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading proto_descriptor_set: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(buf, &set); err != nil {
+		return nil, fmt.Errorf("failed parsing proto_descriptor_set %s: %w", cfg.ProtoDescriptorSet, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proto_descriptor_set %s, it should include imports: %w", cfg.ProtoDescriptorSet, err)
+	}
+
+	c := &Codec{files: files, messages: cfg.ProtoMessages}
+	for _, message := range cfg.ProtoMessages {
+		if _, err := path.Match(message.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid proto_messages path %q: %w", message.Path, err)
+		}
+		for _, name := range []string{message.Request, message.Response} {
+			if _, err := c.messageType(name); name != "" && err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Codec) messageType(name string) (protoreflect.MessageDescriptor, error) {
+	desc, err := c.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("message type %s not found in the proto_descriptor_set: %w", name, err)
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message type", name)
+	}
+	return message, nil
+}
+
+// Types returns the request and response message types of a URL path or gRPC
+// method, from the first matching proto_messages entry or else from the
+// services of the descriptor set. They are nil when unknown.
+func (c *Codec) Types(urlPath string) (request protoreflect.MessageDescriptor, response protoreflect.MessageDescriptor) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, message := range c.messages {
+		if ok, _ := path.Match(message.Path, urlPath); !ok {
+			continue
+		}
+		if message.Request != "" {
+			request, _ = c.messageType(message.Request)
+		}
+		if message.Response != "" {
+			response, _ = c.messageType(message.Response)
+		}
+		return request, response
+	}
+
+	// gRPC methods are named /<service>/<method>.
+	service, method, ok := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	if !ok {
+		return nil, nil
+	}
+	desc, err := c.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, nil
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, nil
+	}
+	methodDesc := serviceDesc.Methods().ByName(protoreflect.Name(method))
+	if methodDesc == nil {
+		return nil, nil
+	}
+	return methodDesc.Input(), methodDesc.Output()
+}
+
+// IsProtobuf reports whether a content type is a protobuf body.
+func IsProtobuf(contentType string) bool {
+	return strings.Contains(contentType, "protobuf")
+}
+
+// ToJSON decodes a binary message of the given type to compact JSON.
+func ToJSON(desc protoreflect.MessageDescriptor, data []byte) (json.RawMessage, error) {
+	message := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	buf, err := protojson.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	// protojson randomly adds spaces to its output, which is not stable.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
+
+// FromJSON encodes a JSON message of the given type to binary, with the
+// deterministic field order.
+func FromJSON(desc protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	message := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(message)
+}
+
+// ToExactJSON decodes a binary message to JSON like ToJSON, but only when
+// FromJSON encodes the JSON back to the exact same bytes, so that nothing,
+// such as unknown fields or the field order, is lost.
+func ToExactJSON(desc protoreflect.MessageDescriptor, data []byte) (json.RawMessage, bool) {
+	message, err := ToJSON(desc, data)
+	if err != nil {
+		return nil, false
+	}
+	encoded, err := FromJSON(desc, message)
+	if err != nil || !bytes.Equal(encoded, data) {
+		return nil, false
+	}
+	return message, true
+}
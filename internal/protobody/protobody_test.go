@@ -0,0 +1,208 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package protobody
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeDescriptorSet writes the descriptor set of a test/echo.proto file with
+// a ChatMessage message and an Echo service.
+func writeDescriptorSet(t *testing.T) string {
+	field := func(name string, number int32, fieldType descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     fieldType.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test/echo.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("ChatMessage"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("text", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				},
+			},
+			{Name: proto.String("Summary")},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Chat"),
+				InputType:  proto.String(".test.ChatMessage"),
+				OutputType: proto.String(".test.Summary"),
+			}},
+		}},
+	}}}
+	buf, err := proto.Marshal(set)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "echo.pb")
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	return path
+}
+
+func TestNew(t *testing.T) {
+	descriptorSet := writeDescriptorSet(t)
+	testCases := []struct {
+		name        string
+		config      config.EndpointConfig
+		expectedErr string
+	}{
+		{
+			name:   "Valid",
+			config: config.EndpointConfig{ProtoDescriptorSet: descriptorSet, ProtoMessages: []config.ProtoMessage{{Path: "/v1/*", Request: "test.ChatMessage"}}},
+		},
+		{
+			name:        "Messages without a descriptor set",
+			config:      config.EndpointConfig{ProtoMessages: []config.ProtoMessage{{Path: "/v1/*", Request: "test.ChatMessage"}}},
+			expectedErr: "proto_messages requires a proto_descriptor_set",
+		},
+		{
+			name:        "Missing file",
+			config:      config.EndpointConfig{ProtoDescriptorSet: filepath.Join(t.TempDir(), "missing.pb")},
+			expectedErr: "failed reading proto_descriptor_set",
+		},
+		{
+			name:        "Unknown message type",
+			config:      config.EndpointConfig{ProtoDescriptorSet: descriptorSet, ProtoMessages: []config.ProtoMessage{{Path: "/v1/*", Response: "test.Missing"}}},
+			expectedErr: "message type test.Missing not found",
+		},
+		{
+			name:        "Invalid path pattern",
+			config:      config.EndpointConfig{ProtoDescriptorSet: descriptorSet, ProtoMessages: []config.ProtoMessage{{Path: "/v1/[", Request: "test.ChatMessage"}}},
+			expectedErr: "invalid proto_messages path",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			codec, err := New(&tc.config)
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, codec)
+		})
+	}
+
+	codec, err := New(&config.EndpointConfig{})
+	require.NoError(t, err)
+	require.Nil(t, codec, "endpoints without a descriptor set should have no codec")
+}
+
+func TestCodec_Types(t *testing.T) {
+	codec, err := New(&config.EndpointConfig{
+		ProtoDescriptorSet: writeDescriptorSet(t),
+		ProtoMessages: []config.ProtoMessage{
+			{Path: "/v1/chats/*:send", Request: "test.ChatMessage", Response: "test.Summary"},
+			{Path: "/test.Echo/Chat", Request: "test.Summary"},
+		},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		path             string
+		expectedRequest  string
+		expectedResponse string
+	}{
+		{path: "/v1/chats/abc:send", expectedRequest: "test.ChatMessage", expectedResponse: "test.Summary"},
+		{path: "/v1/chats/abc/def:send"},
+		{path: "/test.Echo/Chat", expectedRequest: "test.Summary"},
+		{path: "/test.Echo/Other"},
+		{path: "/test.Missing/Chat"},
+		{path: "/test.ChatMessage/Chat"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			request, response := codec.Types(tc.path)
+			if tc.expectedRequest == "" {
+				require.Nil(t, request)
+			} else {
+				require.Equal(t, tc.expectedRequest, string(request.FullName()))
+			}
+			if tc.expectedResponse == "" {
+				require.Nil(t, response)
+			} else {
+				require.Equal(t, tc.expectedResponse, string(response.FullName()))
+			}
+		})
+	}
+
+	// Without proto_messages entry, gRPC methods are found in the services.
+	codec, err = New(&config.EndpointConfig{ProtoDescriptorSet: writeDescriptorSet(t)})
+	require.NoError(t, err)
+	request, response := codec.Types("/test.Echo/Chat")
+	require.Equal(t, "test.ChatMessage", string(request.FullName()))
+	require.Equal(t, "test.Summary", string(response.FullName()))
+
+	var nilCodec *Codec
+	request, response = nilCodec.Types("/test.Echo/Chat")
+	require.Nil(t, request)
+	require.Nil(t, response)
+}
+
+func TestJSON_Roundtrip(t *testing.T) {
+	codec, err := New(&config.EndpointConfig{ProtoDescriptorSet: writeDescriptorSet(t)})
+	require.NoError(t, err)
+	messageType, _ := codec.Types("/test.Echo/Chat")
+
+	// text: "héllo", count: 3
+	data := []byte{0x0a, 0x06, 'h', 0xc3, 0xa9, 'l', 'l', 'o', 0x10, 0x03}
+	decoded, err := ToJSON(messageType, data)
+	require.NoError(t, err)
+	require.Equal(t, `{"text":"héllo","count":"3"}`, string(decoded))
+	encoded, err := FromJSON(messageType, decoded)
+	require.NoError(t, err)
+	require.Equal(t, data, encoded)
+
+	exact, ok := ToExactJSON(messageType, data)
+	require.True(t, ok)
+	require.Equal(t, decoded, exact)
+
+	// Fields out of order and unknown fields are lost when encoding JSON back.
+	_, ok = ToExactJSON(messageType, []byte{0x10, 0x03, 0x0a, 0x01, 'a'})
+	require.False(t, ok, "fields out of order should be kept as binary")
+	_, ok = ToExactJSON(messageType, []byte{0x18, 0x01})
+	require.False(t, ok, "unknown fields should be kept as binary")
+	_, ok = ToExactJSON(messageType, []byte{0x0a, 0x05})
+	require.False(t, ok, "invalid messages should be kept as binary")
+
+	_, err = FromJSON(messageType, []byte(`{"missing":1}`))
+	require.Error(t, err)
+}
+
+func TestIsProtobuf(t *testing.T) {
+	require.True(t, IsProtobuf("application/x-protobuf"))
+	require.True(t, IsProtobuf("application/protobuf; charset=utf-8"))
+	require.False(t, IsProtobuf("application/json"))
+}
@@ -21,35 +21,68 @@ import (
 	"os"
 	"sync"
 
+	"github.com/google/test-server/internal/authemu"
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
 )
 
-func Record(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact) error {
+// recordingProxy is a proxy recording the traffic of an endpoint.
+type recordingProxy interface {
+	ResolveUpstreamCredentials(baseDir string) error
+	LoadProtoDescriptors() error
+	Start() error
+}
+
+func Record(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) error {
 	// Create recording directory if it doesn't exist
 	if err := os.MkdirAll(recordingDir, 0755); err != nil {
 		return fmt.Errorf("failed to create recording directory: %w", err)
 	}
 
+	// Resolve the upstream credentials and load the descriptor sets before
+	// starting any proxy, so that a missing credential or file fails fast.
+	proxies := make([]recordingProxy, len(cfg.Endpoints))
+	for i := range cfg.Endpoints {
+		switch cfg.Endpoints[i].Type {
+		case config.EndpointTypeAuthEmulator:
+			continue
+		case config.EndpointTypeGRPC:
+			proxies[i] = NewRecordingGRPCProxy(&cfg.Endpoints[i], recordingDir, redactor, reporter)
+		default:
+			proxies[i] = NewRecordingHTTPSProxy(&cfg.Endpoints[i], recordingDir, redactor, reporter)
+		}
+		if err := proxies[i].ResolveUpstreamCredentials(cfg.BaseDir); err != nil {
+			return err
+		}
+		if err := proxies[i].LoadProtoDescriptors(); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("Recording to directory: %s\n", recordingDir)
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(cfg.Endpoints))
 
 	// Start a proxy for each endpoint
-	for _, endpoint := range cfg.Endpoints {
+	for i, endpoint := range cfg.Endpoints {
 		wg.Add(1)
-		go func(ep config.EndpointConfig) {
+		go func(ep config.EndpointConfig, proxy recordingProxy) {
 			defer wg.Done()
 
-			fmt.Printf("Starting server for %v\n", endpoint)
-			proxy := NewRecordingHTTPSProxy(&endpoint, recordingDir, redactor)
-			err := proxy.Start()
+			fmt.Printf("Starting server for %v\n", ep)
+			var err error
+			if ep.Type == config.EndpointTypeAuthEmulator {
+				err = authemu.NewServer(&ep).Start()
+			} else {
+				err = proxy.Start()
+			}
 
 			if err != nil {
 				errChan <- fmt.Errorf("proxy error for %s:%d: %w",
 					ep.TargetHost, ep.TargetPort, err)
 			}
-		}(endpoint)
+		}(endpoint, proxies[i])
 	}
 
 	// Wait for all proxies to complete (they shouldn't unless there's an error)
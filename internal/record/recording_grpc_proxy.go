@@ -0,0 +1,289 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/protobody"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
+	"github.com/google/test-server/internal/store"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// grpcCodeUnavailable is the gRPC status code sent when the target cannot be
+// reached.
+const grpcCodeUnavailable = 14
+
+// RecordingGRPCProxy proxies gRPC calls to the target over HTTP/2, and records
+// them to <fileName>.grpc.json.
+type RecordingGRPCProxy struct {
+	config       *config.EndpointConfig
+	recordingDir string
+	redactor     *redact.Redact
+	reporter     *report.Report
+	upstream     upstreamCredentials
+	codec        *protobody.Codec
+	client       *http.Client
+	// recordings holds the calls recorded per file name, guarded by mu since
+	// calls are proxied concurrently.
+	mu         sync.Mutex
+	recordings map[string]*store.GRPCRecording
+}
+
+func NewRecordingGRPCProxy(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) *RecordingGRPCProxy {
+	return &RecordingGRPCProxy{
+		config:       cfg,
+		recordingDir: recordingDir,
+		redactor:     redactor,
+		reporter:     reporter,
+		client:       &http.Client{Transport: newHTTP2Transport(cfg.TargetType)},
+		recordings:   make(map[string]*store.GRPCRecording),
+	}
+}
+
+// newHTTP2Transport returns a transport speaking HTTP/2 to the target, over
+// TLS for an https target and with prior knowledge (h2c) otherwise.
+func newHTTP2Transport(targetType string) *http2.Transport {
+	if targetType == "https" {
+		return &http2.Transport{}
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// ResolveUpstreamCredentials resolves the upstream headers and query params of
+// the endpoint, which are added to every call forwarded to the target.
+// Relative file paths are resolved against baseDir.
+func (r *RecordingGRPCProxy) ResolveUpstreamCredentials(baseDir string) error {
+	upstream, err := resolveUpstreamCredentials(r.config, baseDir)
+	if err != nil {
+		return err
+	}
+	r.upstream = upstream
+	return nil
+}
+
+// LoadProtoDescriptors loads the proto_descriptor_set of the endpoint, to
+// record protobuf bodies as JSON.
+func (r *RecordingGRPCProxy) LoadProtoDescriptors() error {
+	codec, err := protobody.New(r.config)
+	if err != nil {
+		return err
+	}
+	r.codec = codec
+	return nil
+}
+
+func (r *RecordingGRPCProxy) Start() error {
+	if err := listen.ListenAndServe(r.config, r); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// ServeHTTP proxies and records a gRPC call.
+func (r *RecordingGRPCProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == r.config.Health {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, fmt.Sprintf("Unsupported content type for a gRPC endpoint: %q", req.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+	fmt.Printf("Recording gRPC call: %s\n", req.URL.Path)
+
+	recReq := store.NewGRPCRequest(req, *r.config)
+	if err := recReq.Redact(r.config, r.redactor); err != nil {
+		fmt.Printf("Error recording gRPC call: %v\n", err)
+		writeGRPCError(w, store.GRPCCodeInternal, fmt.Sprintf("Error recording gRPC call: %v", err))
+		return
+	}
+	fileName, err := recReq.GetRecordingFileName()
+	if err != nil {
+		fmt.Printf("Invalid recording file name: %v\n", err)
+		writeGRPCError(w, store.GRPCCodeInternal, fmt.Sprintf("Invalid recording file name: %v", err))
+		return
+	}
+
+	call, err := r.proxyCall(w, req, store.NewGRPCCall(recReq))
+	if err != nil {
+		fmt.Printf("Error proxying gRPC call: %v\n", err)
+		return
+	}
+	if err := call.Redact(r.config, r.redactor); err != nil {
+		fmt.Printf("Error recording gRPC call: %v\n", err)
+		return
+	}
+	if err := r.recordCall(fileName, call); err != nil {
+		fmt.Printf("Error recording gRPC call: %v\n", err)
+	}
+}
+
+// proxyCall forwards the call to the target, streaming the messages of both
+// directions as they are received, and returns the call with its messages,
+// response metadata, status and trailers.
+func (r *RecordingGRPCProxy) proxyCall(w http.ResponseWriter, req *http.Request, call *store.GRPCCall) (*store.GRPCCall, error) {
+	scheme := "http"
+	if r.config.TargetType == "https" {
+		scheme = "https"
+	}
+	requestType, responseType := r.codec.Types(req.URL.Path)
+	recorder := &grpcRecorder{
+		call:  call,
+		start: time.Now(),
+		types: map[string]protoreflect.MessageDescriptor{
+			store.DirectionClient: requestType,
+			store.DirectionServer: responseType,
+		},
+	}
+
+	// Forward the client messages through a pipe, so that they are recorded
+	// as the target reads them.
+	body, bodyWriter := io.Pipe()
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		bodyWriter.CloseWithError(recorder.copyMessages(req.Body, bodyWriter, store.DirectionClient))
+	}()
+	defer func() {
+		// The target may end the call before the client is done sending.
+		req.Body.Close()
+		body.Close()
+		<-clientDone
+	}()
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, r.upstream.url(r.config, scheme, req.URL), body)
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.Header = req.Header.Clone()
+	r.upstream.addHeaders(proxyReq.Header)
+
+	resp, err := r.client.Do(proxyReq)
+	if err != nil {
+		writeGRPCError(w, grpcCodeUnavailable, fmt.Sprintf("Error proxying gRPC call: %v", err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if err := recorder.copyMessages(resp.Body, w, store.DirectionServer); err != nil {
+		return nil, err
+	}
+	// The trailers are only known once the response body was read.
+	for name, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+	call.SetResponse(resp.StatusCode, resp.Header, resp.Trailer)
+	return call, nil
+}
+
+// recordCall appends the call to the recording of the test and writes it.
+func (r *RecordingGRPCProxy) recordCall(fileName string, call *store.GRPCCall) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recording, ok := r.recordings[fileName]
+	if !ok {
+		recording = &store.GRPCRecording{RecordID: fileName}
+		r.recordings[fileName] = recording
+	}
+	recording.Calls = append(recording.Calls, call)
+
+	buf, err := recording.Marshal()
+	if err != nil {
+		return err
+	}
+	recordPath := filepath.Join(r.recordingDir, fileName+".grpc.json")
+	if err := os.WriteFile(recordPath, buf, 0644); err != nil {
+		return err
+	}
+	r.reporter.Recorded(fileName, recordPath)
+	return nil
+}
+
+// grpcRecorder records the messages of both directions of a call.
+type grpcRecorder struct {
+	mu    sync.Mutex
+	call  *store.GRPCCall
+	start time.Time
+	// types are the message types per direction, nil when unknown.
+	types map[string]protoreflect.MessageDescriptor
+}
+
+// copyMessages copies the length-prefixed messages of src to dst until src
+// ends, and records them. Every message is flushed when dst is a flusher.
+func (g *grpcRecorder) copyMessages(src io.Reader, dst io.Writer, direction string) error {
+	for {
+		compressed, data, err := store.ReadGRPCFrame(src)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		message := store.NewGRPCMessage(direction, compressed, data, time.Since(g.start))
+		if messageType := g.types[direction]; messageType != nil && !compressed {
+			if decoded, ok := protobody.ToExactJSON(messageType, data); ok {
+				message.SetJSON(decoded)
+			}
+		}
+		g.mu.Lock()
+		g.call.Messages = append(g.call.Messages, message)
+		g.mu.Unlock()
+		if _, err := dst.Write(store.FormatGRPCFrame(compressed, data)); err != nil {
+			return err
+		}
+		if flusher, ok := dst.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// writeGRPCError ends a call with the given status, in a trailers-only
+// response.
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", store.EncodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
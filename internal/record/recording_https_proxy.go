@@ -25,10 +25,17 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/protobody"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
 	"github.com/google/test-server/internal/store"
+	"github.com/google/test-server/internal/wsconn"
 	"github.com/gorilla/websocket"
 )
 
@@ -38,15 +45,24 @@ type RecordingHTTPSProxy struct {
 	config         *config.EndpointConfig
 	recordingDir   string
 	redactor       *redact.Redact
+	reporter       *report.Report
+	upstream       upstreamCredentials
+	codec          *protobody.Codec
+	// websocketRecordings holds the sessions recorded per file name, guarded by
+	// websocketMu since websocket connections are proxied concurrently.
+	websocketMu         sync.Mutex
+	websocketRecordings map[string]*store.WebsocketRecording
 }
 
-func NewRecordingHTTPSProxy(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact) *RecordingHTTPSProxy {
+func NewRecordingHTTPSProxy(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) *RecordingHTTPSProxy {
 	return &RecordingHTTPSProxy{
-		prevRequestSHA: store.HeadSHA,
-		seenFiles:      make(map[string]store.RecordFile),
-		config:         cfg,
-		recordingDir:   recordingDir,
-		redactor:       redactor,
+		prevRequestSHA:      store.HeadSHA,
+		seenFiles:           make(map[string]store.RecordFile),
+		websocketRecordings: make(map[string]*store.WebsocketRecording),
+		config:              cfg,
+		recordingDir:        recordingDir,
+		redactor:            redactor,
+		reporter:            reporter,
 	}
 }
 
@@ -54,13 +70,36 @@ func (r *RecordingHTTPSProxy) ResetChain() {
 	r.prevRequestSHA = store.HeadSHA
 }
 
-func (r *RecordingHTTPSProxy) Start() error {
-	addr := fmt.Sprintf(":%d", r.config.SourcePort)
-	server := &http.Server{
-		Addr:    addr,
-		Handler: http.HandlerFunc(r.handleRequest),
+// ResolveUpstreamCredentials resolves the upstream headers and query params of
+// the endpoint, which are added to every request forwarded to the target.
+// Relative file paths are resolved against baseDir.
+func (r *RecordingHTTPSProxy) ResolveUpstreamCredentials(baseDir string) error {
+	upstream, err := resolveUpstreamCredentials(r.config, baseDir)
+	if err != nil {
+		return err
+	}
+	r.upstream = upstream
+	return nil
+}
+
+// LoadProtoDescriptors loads the proto_descriptor_set of the endpoint, to
+// record protobuf bodies as JSON.
+func (r *RecordingHTTPSProxy) LoadProtoDescriptors() error {
+	codec, err := protobody.New(r.config)
+	if err != nil {
+		return err
 	}
-	if err := server.ListenAndServe(); err != nil {
+	r.codec = codec
+	return nil
+}
+
+// ServeHTTP proxies and records a request.
+func (r *RecordingHTTPSProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handleRequest(w, req)
+}
+
+func (r *RecordingHTTPSProxy) Start() error {
+	if err := listen.ListenAndServe(r.config, http.HandlerFunc(r.handleRequest)); err != nil {
 		panic(err)
 	}
 	return nil
@@ -92,7 +131,7 @@ func (r *RecordingHTTPSProxy) handleRequest(w http.ResponseWriter, req *http.Req
 
 	if req.Header.Get("Upgrade") == "websocket" {
 		fmt.Printf("Upgrading connection to websocket...\n")
-		r.proxyWebsocket(w, req, fileName)
+		r.proxyWebsocket(w, req, fileName, recReq)
 		return
 	}
 
@@ -115,30 +154,20 @@ func (r *RecordingHTTPSProxy) handleRequest(w http.ResponseWriter, req *http.Req
 }
 
 func (r *RecordingHTTPSProxy) redactRequest(req *http.Request) (*store.RecordedRequest, error) {
-	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config)
+	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config, r.codec)
 	if err != nil {
 		return recordedRequest, err
 	}
 
-	// Redact headers by key
-	recordedRequest.RedactHeaders(r.config.RedactRequestHeaders)
-	// Redacts secrets from header values
-	r.redactor.Headers(recordedRequest.Headers)
-	recordedRequest.Request = r.redactor.String(recordedRequest.Request)
-	recordedRequest.URL = r.redactor.String(recordedRequest.URL)
-	var redactedBodySegments []map[string]any
-	for _, bodySegment := range recordedRequest.BodySegments {
-		redactedBodySegments = append(redactedBodySegments, r.redactor.Map(bodySegment))
+	err = recordedRequest.Redact(r.config, r.redactor)
+	if err != nil {
+		return nil, err
 	}
-	recordedRequest.BodySegments = redactedBodySegments
 	return recordedRequest, nil
 }
 
 func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Request) (*http.Response, []byte, error) {
-	url := fmt.Sprintf("%s://%s:%d%s", r.config.TargetType, r.config.TargetHost, r.config.TargetPort, req.URL.Path)
-	if req.URL.RawQuery != "" {
-		url += "?" + req.URL.RawQuery
-	}
+	url := r.upstream.url(r.config, r.config.TargetType, req.URL)
 
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -156,6 +185,7 @@ func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Requ
 			proxyReq.Header.Add(name, value)
 		}
 	}
+	r.upstream.addHeaders(proxyReq.Header)
 
 	resp, err := http.DefaultClient.Do(proxyReq)
 	if err != nil {
@@ -165,27 +195,45 @@ func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Requ
 	r.applyResponseHeaderReplacements(resp.Header)
 
 	for name, values := range resp.Header {
+		if listen.IsConnectionHeader(name) {
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
 
-	w.WriteHeader(resp.StatusCode)
-
 	respBodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	w.Write(respBodyBytes) // Send original (compressed) body to client
+	// Send original (compressed) body to client, followed by the trailers,
+	// which are only known once the body was read.
+	statusText := ""
+	if r.config.SendStatusText {
+		statusText = store.StatusText(resp)
+	}
+	if err := listen.WriteResponse(w, req, resp.StatusCode, statusText, respBodyBytes, resp.Trailer); err != nil {
+		fmt.Printf("Error writing response: %v\n", err)
+	}
 	return resp, respBodyBytes, nil
 }
 
 func (r *RecordingHTTPSProxy) recordResponse(recReq *store.RecordedRequest, resp *http.Response, fileName string, shaSum string, body []byte) error {
-	recordedResponse, err := store.NewRecordedResponse(resp, body)
+	recordedResponse, err := store.NewRecordedResponse(resp, body, r.codec)
+	if err != nil {
+		return err
+	}
+	err = recordedResponse.Redact(r.config, r.redactor)
 	if err != nil {
 		return err
 	}
+	// Replay encodes the body with the message type of the recorded path.
+	path, _, _ := strings.Cut(recReq.URL, "?")
+	if err := recordedResponse.CheckProtoBody(path, r.codec); err != nil {
+		return err
+	}
 
 	recordFile, ok := r.seenFiles[fileName]
 	if !ok {
@@ -221,6 +269,7 @@ func (r *RecordingHTTPSProxy) recordResponse(recReq *store.RecordedRequest, resp
 		return err
 	}
 
+	r.reporter.Recorded(fileName, recordPath)
 	return nil
 }
 
@@ -243,63 +292,119 @@ func replaceRegex(s, regex, replacement string) string {
 	return re.ReplaceAllString(s, replacement)
 }
 
-func (r *RecordingHTTPSProxy) proxyWebsocket(w http.ResponseWriter, req *http.Request, fileName string) {
-	conn, clientConn, err := r.upgradeConnectionToWebsocket(w, req)
+// proxyWebsocket proxies a websocket connection, and records it as a new
+// session of the websocket recording of the test.
+func (r *RecordingHTTPSProxy) proxyWebsocket(w http.ResponseWriter, req *http.Request, fileName string, recReq *store.RecordedRequest) {
+	conn, clientConn, handshake, err := r.upgradeConnectionToWebsocket(w, req)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error proxying websocket: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer conn.Close()
 	defer clientConn.Close()
+	if err := handshake.Redact(r.config, r.redactor); err != nil {
+		fmt.Printf("Error recording websocket handshake: %v\n", err)
+		return
+	}
 
-	c := make(chan []byte)
+	c := make(chan *store.WebsocketFrame)
 	quit := make(chan int)
+	start := time.Now()
 
-	go r.pumpWebsocket(clientConn, conn, c, quit, ">")
-	go r.pumpWebsocket(conn, clientConn, c, quit, "<")
+	watchdog := wsconn.NewIdleWatchdog(r.config.WebsocketIdleTimeout, clientConn, conn)
+	defer watchdog.Stop()
 
-	recordPath := filepath.Join(r.recordingDir, fileName+".websocket.log")
-	f, err := os.Create(recordPath)
-	if err != nil {
-		fmt.Printf("Error creating websocket recording file: %v\n", err)
-		http.Error(w, fmt.Sprintf("Error proxying websocket: %v", err), http.StatusInternalServerError)
-		return
+	go r.pumpWebsocket(clientConn, conn, c, quit, store.DirectionClient, start, watchdog)
+	go r.pumpWebsocket(conn, clientConn, c, quit, store.DirectionServer, start, watchdog)
+
+	// Sessions are stored in the order the connections were opened.
+	session := store.NewWebsocketSession(recReq)
+	session.Response = handshake
+	r.websocketMu.Lock()
+	recording, ok := r.websocketRecordings[fileName]
+	if !ok {
+		recording = &store.WebsocketRecording{RecordID: fileName}
+		r.websocketRecordings[fileName] = recording
 	}
-	defer f.Close()
+	recording.Sessions = append(recording.Sessions, session)
+	r.websocketMu.Unlock()
 
+	var frames []*store.WebsocketFrame
 	quitCount := 0
-	for {
+	for quitCount < 2 {
 		select {
-		case buf := <-c:
-			_, err := f.Write(buf)
-			if err != nil {
-				panic(fmt.Sprintf("Error writing to websocket recording file: %v\n", err))
-			}
+		case frame := <-c:
+			frames = append(frames, frame)
 		case <-quit:
 			quitCount += 1
-			if quitCount == 2 {
-				return
-			}
 		}
 	}
+
+	r.websocketMu.Lock()
+	defer r.websocketMu.Unlock()
+	session.Frames = frames
+	recordPath := filepath.Join(r.recordingDir, fileName+".websocket.json")
+	buf, err := recording.Marshal()
+	if err != nil {
+		panic(fmt.Sprintf("Error marshaling websocket recording: %v\n", err))
+	}
+	if err := os.WriteFile(recordPath, buf, 0644); err != nil {
+		panic(fmt.Sprintf("Error writing to websocket recording file: %v\n", err))
+	}
+	r.reporter.Recorded(fileName, recordPath)
 }
 
-func (r *RecordingHTTPSProxy) pumpWebsocket(src, dst *websocket.Conn, c chan []byte, quit chan int, prepend string) {
+// pumpWebsocket forwards the messages of src to dst and sends the redacted
+// frames to c, until src is closed.
+func (r *RecordingHTTPSProxy) pumpWebsocket(src, dst *websocket.Conn, c chan *store.WebsocketFrame, quit chan int, direction string, start time.Time, watchdog *wsconn.IdleWatchdog) {
+	// Pings and pongs are forwarded rather than answered, so that they reach
+	// the other side, and recorded when configured.
+	forwardControl := func(messageType int, opcode string) func(string) error {
+		return func(data string) error {
+			watchdog.Touch()
+			if r.config.RecordWebsocketPings {
+				c <- store.NewWebsocketFrame(direction, opcode, r.redactor.Bytes([]byte(data)), time.Since(start))
+			}
+			if err := wsconn.WriteControl(dst, messageType, data); err != nil {
+				fmt.Printf("Error forwarding websocket %s: %v\n", opcode, err)
+			}
+			return nil
+		}
+	}
+	src.SetPingHandler(forwardControl(websocket.PingMessage, store.OpcodePing))
+	src.SetPongHandler(forwardControl(websocket.PongMessage, store.OpcodePong))
+
 	for {
 		msgType, buf, err := src.ReadMessage()
+		watchdog.Touch()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err) {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				frame := store.NewWebsocketFrame(direction, store.OpcodeClose, nil, time.Since(start))
+				frame.CloseCode = closeErr.Code
+				frame.CloseReason = r.redactor.String(closeErr.Text)
+				c <- frame
+				if wsconn.IsReservedCloseCode(closeErr.Code) {
+					// The peer sent no close status, such as when the connection
+					// dropped, so the other side's connection is dropped too.
+					dst.Close()
+				} else {
+					// Forward the close so that the other side sees the same status.
+					wsconn.Close(dst, closeErr.Code, closeErr.Text)
+				}
 				quit <- 0
 				return
 			}
 			fmt.Printf("Error reading from websocket\n")
+			// Unblock the other pump.
+			dst.Close()
 			quit <- 1
 			return
 		}
-		buf = append(buf, '\n')
-		redactedBuf := r.redactor.Bytes(buf)
-		prefix := fmt.Sprintf("%s%d ", prepend, len(redactedBuf))
-		c <- append([]byte(prefix), redactedBuf...)
+		opcode := store.OpcodeBinary
+		if msgType == websocket.TextMessage {
+			opcode = store.OpcodeText
+		}
+		c <- store.NewWebsocketFrame(direction, opcode, r.redactor.Bytes(bytes.Clone(buf)), time.Since(start))
 		err = dst.WriteMessage(msgType, buf)
 		if err != nil {
 			fmt.Printf("Error writing to websocket: %v\n", err)
@@ -309,17 +414,18 @@ func (r *RecordingHTTPSProxy) pumpWebsocket(src, dst *websocket.Conn, c chan []b
 	}
 }
 
-func (r *RecordingHTTPSProxy) upgradeConnectionToWebsocket(w http.ResponseWriter, req *http.Request) (*websocket.Conn, *websocket.Conn, error) {
-	url := fmt.Sprintf("wss://%s:%d%s", r.config.TargetHost, r.config.TargetPort, req.URL.Path)
-	if req.URL.RawQuery != "" {
-		url += "?" + req.URL.RawQuery
-	}
+// upgradeConnectionToWebsocket dials the target and upgrades the client
+// connection with the subprotocol and headers of the target handshake
+// response, which is returned.
+func (r *RecordingHTTPSProxy) upgradeConnectionToWebsocket(w http.ResponseWriter, req *http.Request) (*websocket.Conn, *websocket.Conn, *store.RecordedResponse, error) {
+	url := r.upstream.url(r.config, r.config.WebsocketScheme(), req.URL)
 
 	dialHeaders := http.Header{}
 	excludedHeaders := map[string]bool{
 		"Sec-Websocket-Version":    true,
 		"Sec-Websocket-Key":        true,
 		"Sec-Websocket-Extensions": true,
+		"Sec-Websocket-Protocol":   true,
 		"Connection":               true,
 		"Upgrade":                  true,
 		"Test-Name":                true,
@@ -330,13 +436,19 @@ func (r *RecordingHTTPSProxy) upgradeConnectionToWebsocket(w http.ResponseWriter
 		}
 		dialHeaders[k] = v
 	}
+	r.upstream.addHeaders(dialHeaders)
 
-	dialer := websocket.Dialer{}
-	conn, _, err := dialer.Dial(url, dialHeaders)
+	dialer := websocket.Dialer{Subprotocols: websocket.Subprotocols(req)}
+	conn, resp, err := dialer.Dial(url, dialHeaders)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	handshake := &store.RecordedResponse{
+		StatusCode: int32(resp.StatusCode),
+		Headers:    store.GetHeadersMap(&resp.Header),
 	}
 
+	responseHeader, subprotocol := store.UpgradeResponseHeader(handshake.Headers)
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -344,10 +456,14 @@ func (r *RecordingHTTPSProxy) upgradeConnectionToWebsocket(w http.ResponseWriter
 			return true // Allow all origins
 		},
 	}
+	if subprotocol != "" {
+		upgrader.Subprotocols = []string{subprotocol}
+	}
 
-	clientConn, err := upgrader.Upgrade(w, req, nil)
+	clientConn, err := upgrader.Upgrade(w, req, responseHeader)
 	if err != nil {
-		return nil, nil, err
+		conn.Close()
+		return nil, nil, nil, err
 	}
-	return conn, clientConn, err
+	return conn, clientConn, handshake, err
 }
@@ -0,0 +1,93 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingHTTPSProxy_UpstreamCredentials(t *testing.T) {
+	t.Setenv("TEST_SERVER_TEST_API_KEY", "real-key")
+	t.Setenv("TEST_SERVER_TEST_TOKEN", "real-token")
+
+	var upstreamReq *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamReq = req
+		w.Write([]byte(`{"echo":"` + req.URL.Query().Get("key") + `"}`))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+
+	cfg := &config.EndpointConfig{
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+		// The target echoes the key, which is redacted from the response.
+		RedactResponses: true,
+		UpstreamHeaders: []config.UpstreamCredential{
+			{Name: "Authorization", Prefix: "Bearer ", Source: config.SecretSource{Env: "TEST_SERVER_TEST_TOKEN"}},
+		},
+		UpstreamQueryParams: []config.UpstreamCredential{
+			{Name: "key", Source: config.SecretSource{Env: "TEST_SERVER_TEST_API_KEY"}},
+		},
+	}
+	redactor, err := redact.NewRedact([]string{"real-key", "real-token"})
+	require.NoError(t, err)
+	recordingDir := t.TempDir()
+	proxy := NewRecordingHTTPSProxy(cfg, recordingDir, redactor, nil)
+	require.NoError(t, proxy.ResolveUpstreamCredentials(t.TempDir()))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/models?key=dummy&page=2", nil)
+	req.Header.Set("Authorization", "Bearer dummy")
+	req.Header.Set("Test-Name", "upstream-credentials")
+	w := httptest.NewRecorder()
+	proxy.handleRequest(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Bearer real-token", upstreamReq.Header.Get("Authorization"))
+	require.Equal(t, "real-key", upstreamReq.URL.Query().Get("key"))
+	require.Equal(t, "2", upstreamReq.URL.Query().Get("page"))
+
+	recording, err := os.ReadFile(filepath.Join(recordingDir, "upstream-credentials.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(recording), "key=dummy")
+	require.NotContains(t, string(recording), "real-key")
+	require.NotContains(t, string(recording), "real-token")
+}
+
+func TestRecordingHTTPSProxy_ResolveUpstreamCredentials_Missing(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		UpstreamHeaders: []config.UpstreamCredential{
+			{Name: "x-goog-api-key", Source: config.SecretSource{Env: "TEST_SERVER_TEST_UNSET"}},
+		},
+	}
+	proxy := NewRecordingHTTPSProxy(cfg, t.TempDir(), nil, nil)
+	require.Error(t, proxy.ResolveUpstreamCredentials(t.TempDir()))
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/secrets"
+)
+
+// upstreamCredentials are the resolved upstream headers and query params of an
+// endpoint, which record mode adds to every request forwarded to the target.
+type upstreamCredentials struct {
+	headers http.Header
+	query   url.Values
+}
+
+// resolveUpstreamCredentials resolves the upstream credentials of the
+// endpoint. Relative file paths are resolved against baseDir.
+func resolveUpstreamCredentials(cfg *config.EndpointConfig, baseDir string) (upstreamCredentials, error) {
+	upstream := upstreamCredentials{headers: http.Header{}, query: url.Values{}}
+	for _, cred := range cfg.UpstreamHeaders {
+		value, err := secrets.ResolveCredential(cred, baseDir)
+		if err != nil {
+			return upstream, err
+		}
+		upstream.headers.Set(cred.Name, cred.Prefix+value)
+	}
+	for _, cred := range cfg.UpstreamQueryParams {
+		value, err := secrets.ResolveCredential(cred, baseDir)
+		if err != nil {
+			return upstream, err
+		}
+		upstream.query.Set(cred.Name, cred.Prefix+value)
+	}
+	return upstream, nil
+}
+
+// url returns the URL of the target for the given request, with the upstream
+// query params overriding the ones sent by the client.
+func (u upstreamCredentials) url(cfg *config.EndpointConfig, scheme string, reqURL *url.URL) string {
+	target := fmt.Sprintf("%s://%s:%d%s", scheme, cfg.TargetHost, cfg.TargetPort, reqURL.Path)
+	rawQuery := reqURL.RawQuery
+	if len(u.query) > 0 {
+		query := reqURL.Query()
+		for name, values := range u.query {
+			query[name] = values
+		}
+		rawQuery = query.Encode()
+	}
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	return target
+}
+
+// addHeaders sets the upstream headers, overriding the ones sent by the client.
+func (u upstreamCredentials) addHeaders(headers http.Header) {
+	for name, values := range u.headers {
+		headers[name] = values
+	}
+}
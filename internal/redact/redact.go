@@ -17,87 +17,440 @@ limitations under the License.
 package redact
 
 import (
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/google/test-server/internal/jsonpath"
 )
 
 // REDACTED is the string used to replace redacted secrets.
 const REDACTED = "REDACTED"
 
-// Redact holds the compiled regex for redacting secrets.
+// secretGroup is the name of the capture group that, when present in a
+// pattern, limits the redaction to the part of the match it captures.
+const secretGroup = "secret"
+
+// Detectors maps the names of the built-in detectors to the patterns matching
+// common credential formats.
+var Detectors = map[string]string{
+	"google_api_key":     `AIza[0-9A-Za-z_-]{35}`,
+	"google_oauth_token": `ya29\.[0-9A-Za-z_-]+`,
+	"bearer_token":       `(?i)bearer\s+(?P<secret>[A-Za-z0-9._~+/-]+=*)`,
+	"jwt":                `eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`,
+	"aws_access_key_id":  `(?:AKIA|ASIA)[0-9A-Z]{16}`,
+	"github_token":       `gh[pousr]_[A-Za-z0-9]{36,}`,
+	"slack_token":        `xox[abprs]-[0-9A-Za-z-]{10,}`,
+	"private_key":        `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+// AllDetectors is the detector name that enables every built-in detector.
+const AllDetectors = "all"
+
+// Kinds of findings that are not reported by a detector.
+const (
+	KindSecret  = "secret"
+	KindPattern = "pattern"
+)
+
+// Replacement strategies for redacted secrets.
+const (
+	// ReplacementConstant replaces every secret with REDACTED.
+	ReplacementConstant = "constant"
+	// ReplacementNumbered replaces each distinct secret with REDACTED_<n>, numbered
+	// in the order the secrets are listed. Values found by patterns, detectors
+	// and JSON paths that are not listed secrets are replaced with REDACTED,
+	// since the order they are found in changes between record and replay.
+	ReplacementNumbered = "numbered"
+	// ReplacementHash replaces each distinct secret with REDACTED_<hash>, where
+	// hash is derived from a keyed HMAC of the secret.
+	ReplacementHash = "hash"
+)
+
+// placeholderRegex matches the values secrets are replaced with, so that
+// already redacted values are left untouched.
+var placeholderRegex = regexp.MustCompile(`^` + REDACTED + `(_[0-9a-f]+)?$`)
+
+// Options configures the secrets a Redact instance scrubs.
+type Options struct {
+	// Secrets are literal values to redact.
+	Secrets []string
+	// Credentials are literal values to redact like Secrets, which are also
+	// available on their own from Credentials, such as the credentials sent
+	// upstream.
+	Credentials []string
+	// Patterns are regular expressions to redact. When a pattern has a capture
+	// group named "secret" only that group is redacted.
+	Patterns []string
+	// Detectors are names of built-in detectors, see Detectors.
+	Detectors []string
+	// Replacement is the replacement strategy, ReplacementConstant when empty.
+	Replacement string
+	// Key is the HMAC key used by ReplacementHash, which is required since an
+	// empty key would let low-entropy values be brute-forced from their hash.
+	Key string
+	// Allowed are values that are neither redacted nor reported, even when a
+	// secret, pattern or detector matches them, such as known fake tokens.
+	Allowed []string
+	// AllowedSuffixes are suffixes of values that are allowed like Allowed,
+	// such as the fixed signature of fake tokens.
+	AllowedSuffixes []string
+}
+
+// Redact holds the compiled regexes for redacting secrets.
 type Redact struct {
-	regex *regexp.Regexp
+	regexes     []*regexp.Regexp
+	kinds       []string
+	replacement string
+	key         []byte
+	// numbers are the numbers of the listed secrets for ReplacementNumbered.
+	numbers map[string]int
+	allowed map[string]struct{}
+	// allowedSuffixes are the suffixes of allowed values.
+	allowedSuffixes []string
+	// credentials redacts only the credentials, nil when there are none.
+	credentials *Redact
 }
 
 // NewRedact creates a new Redact instance with the given secrets.
 func NewRedact(secrets []string) (*Redact, error) {
+	return New(Options{Secrets: secrets})
+}
+
+// New creates a new Redact instance with the given options.
+func New(opts Options) (*Redact, error) {
+	r := &Redact{
+		replacement: opts.Replacement,
+		key:         []byte(opts.Key),
+		numbers:     make(map[string]int),
+		allowed:     make(map[string]struct{}),
+	}
+	for _, value := range opts.Allowed {
+		r.allowed[value] = struct{}{}
+	}
+	for _, suffix := range opts.AllowedSuffixes {
+		// An empty suffix would allow every value.
+		if suffix != "" {
+			r.allowedSuffixes = append(r.allowedSuffixes, suffix)
+		}
+	}
+	switch r.replacement {
+	case "":
+		r.replacement = ReplacementConstant
+	case ReplacementConstant, ReplacementNumbered, ReplacementHash:
+	default:
+		return nil, fmt.Errorf("unknown redaction replacement: %s", opts.Replacement)
+	}
+	if r.replacement == ReplacementHash && opts.Key == "" {
+		return nil, fmt.Errorf("the %s redaction replacement requires a key", ReplacementHash)
+	}
+
 	filteredSecrets := []string{}
-	for _, secret := range secrets {
+	for _, secret := range append(append([]string{}, opts.Secrets...), opts.Credentials...) {
 		if secret != "" {
 			filteredSecrets = append(filteredSecrets, regexp.QuoteMeta(secret))
+			if _, ok := r.numbers[secret]; !ok {
+				r.numbers[secret] = len(r.numbers) + 1
+			}
+		}
+	}
+	if len(filteredSecrets) > 0 {
+		if err := r.add(strings.Join(filteredSecrets, "|"), KindSecret); err != nil {
+			return nil, err
 		}
 	}
 
-	if len(filteredSecrets) == 0 {
-		return &Redact{regex: nil}, nil // No secrets to redact
+	for _, pattern := range opts.Patterns {
+		if err := r.add(pattern, KindPattern); err != nil {
+			return nil, err
+		}
+	}
+	detectors, err := detectorNames(opts.Detectors)
+	if err != nil {
+		return nil, err
+	}
+	for _, detector := range detectors {
+		if err := r.add(Detectors[detector], detector); err != nil {
+			return nil, err
+		}
 	}
 
-	regexPattern := strings.Join(filteredSecrets, "|")
-	re, err := regexp.Compile(regexPattern)
+	if len(opts.Credentials) == 0 {
+		return r, nil
+	}
+	credentials, err := New(Options{
+		Secrets:         opts.Credentials,
+		Replacement:     opts.Replacement,
+		Key:             opts.Key,
+		Allowed:         opts.Allowed,
+		AllowedSuffixes: opts.AllowedSuffixes,
+	})
 	if err != nil {
 		return nil, err
 	}
+	if credentials.enabled() {
+		// Share the numbers, so that a credential gets the same placeholder.
+		credentials.numbers = r.numbers
+		r.credentials = credentials
+	}
+	return r, nil
+}
+
+// Credentials returns a Redact that only redacts the credentials of r, with
+// the same placeholders, or nil when r has no credentials.
+func (r *Redact) Credentials() *Redact {
+	if r == nil {
+		return nil
+	}
+	return r.credentials
+}
+
+func (r *Redact) add(pattern string, kind string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+	}
+	r.regexes = append(r.regexes, re)
+	r.kinds = append(r.kinds, kind)
+	return nil
+}
+
+// detectorNames validates the given detector names and expands AllDetectors.
+func detectorNames(names []string) ([]string, error) {
+	var detectors []string
+	for _, name := range names {
+		if name == AllDetectors {
+			all := make([]string, 0, len(Detectors))
+			for detector := range Detectors {
+				all = append(all, detector)
+			}
+			sort.Strings(all)
+			return all, nil
+		}
+		if _, ok := Detectors[name]; !ok {
+			return nil, fmt.Errorf("unknown redaction detector: %s", name)
+		}
+		detectors = append(detectors, name)
+	}
+	return detectors, nil
+}
+
+// IsPlaceholder reports whether value is one of the values secrets are replaced with.
+func IsPlaceholder(value string) bool {
+	return placeholderRegex.MatchString(value)
+}
+
+// enabled reports whether r has any secrets to redact.
+func (r *Redact) enabled() bool {
+	return r != nil && len(r.regexes) > 0
+}
+
+// placeholder returns the value the given secret is replaced with.
+func (r *Redact) placeholder(secret []byte) []byte {
+	if placeholderRegex.Match(secret) {
+		return secret
+	}
+	if r.replacement == ReplacementConstant {
+		return []byte(REDACTED)
+	}
+	if r.replacement == ReplacementHash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write(secret)
+		return []byte(REDACTED + "_" + hex.EncodeToString(mac.Sum(nil)[:8]))
+	}
+
+	number, ok := r.numbers[string(secret)]
+	if !ok {
+		return []byte(REDACTED)
+	}
+	return []byte(fmt.Sprintf("%s_%d", REDACTED, number))
+}
+
+// isAllowed reports whether value is neither redacted nor reported.
+func (r *Redact) isAllowed(value string) bool {
+	if _, ok := r.allowed[value]; ok {
+		return true
+	}
+	for _, suffix := range r.allowedSuffixes {
+		if strings.HasSuffix(value, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactMatch returns the value a match of a regex is replaced with.
+func (r *Redact) redactMatch(secret []byte) []byte {
+	if r.isAllowed(string(secret)) {
+		return secret
+	}
+	return r.placeholder(secret)
+}
+
+// replace redacts every match of every regex in input.
+func (r *Redact) replace(input []byte) []byte {
+	for _, re := range r.regexes {
+		group := re.SubexpIndex(secretGroup)
+		if group < 0 {
+			input = re.ReplaceAllFunc(input, r.redactMatch)
+			continue
+		}
+		var out []byte
+		last := 0
+		for _, match := range re.FindAllSubmatchIndex(input, -1) {
+			start, end := match[2*group], match[2*group+1]
+			if start < 0 {
+				continue
+			}
+			out = append(out, input[last:start]...)
+			out = append(out, r.redactMatch(input[start:end])...)
+			last = end
+		}
+		if out != nil {
+			input = append(out, input[last:]...)
+		}
+	}
+	return input
+}
+
+// Finding is a suspected secret found in a string.
+type Finding struct {
+	// Kind is KindSecret, KindPattern or the name of the detector that found the secret.
+	Kind string
+	// Value is the suspected secret.
+	Value string
+}
 
-	return &Redact{regex: re}, nil
+// Find returns the secrets that would be redacted from input, ignoring the
+// values that are already redacted or allowed.
+func (r *Redact) Find(input string) []Finding {
+	if !r.enabled() {
+		return nil
+	}
+	var findings []Finding
+	for i, re := range r.regexes {
+		group := re.SubexpIndex(secretGroup)
+		for _, match := range re.FindAllStringSubmatchIndex(input, -1) {
+			start, end := match[0], match[1]
+			if group >= 0 {
+				start, end = match[2*group], match[2*group+1]
+			}
+			if start < 0 || placeholderRegex.MatchString(input[start:end]) {
+				continue
+			}
+			if r.isAllowed(input[start:end]) {
+				continue
+			}
+			findings = append(findings, Finding{Kind: r.kinds[i], Value: input[start:end]})
+		}
+	}
+	return findings
 }
 
 // Headers redacts the secrets in the values of the http.Header.
 func (r *Redact) Headers(headers map[string]string) {
-	if r == nil || r.regex == nil {
+	if !r.enabled() {
 		return // No redactor or no secrets configured
 	}
 	for name, value := range headers {
-		headers[name] = r.regex.ReplaceAllString(value, REDACTED)
+		headers[name] = string(r.replace([]byte(value)))
 	}
 }
 
 // String redacts the secrets in the input string.
 func (r *Redact) String(input string) string {
-	if r == nil || r.regex == nil {
+	if !r.enabled() {
 		return input // No redactor or no secrets configured
 	}
-	return r.regex.ReplaceAllString(input, REDACTED)
+	return string(r.replace([]byte(input)))
 }
 
 // Bytes redacts the secrets in the input byte slice.
 func (r *Redact) Bytes(input []byte) []byte {
-	if r == nil || r.regex == nil {
+	if !r.enabled() {
 		return input // No redactor or no secrets configured
 	}
 	if input == nil {
 		return nil // Return nil if input is nil
 	}
-	return r.regex.ReplaceAll(input, []byte(REDACTED))
+	return r.replace(input)
 }
 
+// Map returns a copy of input with the secrets redacted from its keys and
+// string values, at any depth. Values of other types are kept.
 func (r *Redact) Map(input map[string]any) map[string]any {
-	if r == nil || r.regex == nil {
+	if !r.enabled() {
 		return input // No redactor or no secrets configured
 	}
 	if input == nil {
 		return nil // Return nil if input is nil
 	}
-	jsonBytes, err := json.Marshal(input)
-	if err != nil {
-		return nil
+	return r.value(input).(map[string]any)
+}
+
+// value returns a copy of a decoded JSON value with the secrets redacted from
+// its strings.
+func (r *Redact) value(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.String(v)
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for key, item := range v {
+			redacted[r.String(key)] = r.value(item)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = r.value(item)
+		}
+		return redacted
+	default:
+		return value
 	}
-	redactedJsonBytes := r.Bytes(jsonBytes)
-	var redactedMap map[string]any
-	err = json.Unmarshal(redactedJsonBytes, &redactedMap)
-	if err != nil {
-		return nil
+}
+
+// Fields replaces the values addressed by the given JSON paths with
+// placeholders of the same type: strings are replaced like secrets, numbers
+// with 0 and booleans with false. Objects and arrays have all their values
+// replaced. A nil Redact replaces strings with REDACTED.
+func (r *Redact) Fields(input map[string]any, paths []jsonpath.Path) map[string]any {
+	if input == nil || len(paths) == 0 {
+		return input
+	}
+	for _, path := range paths {
+		path.Replace(input, r.field)
 	}
+	return input
+}
 
-	return redactedMap
+func (r *Redact) field(value any) any {
+	switch v := value.(type) {
+	case string:
+		if r == nil {
+			return REDACTED
+		}
+		return string(r.placeholder([]byte(v)))
+	case float64:
+		return float64(0)
+	case bool:
+		return false
+	case map[string]any:
+		for key, item := range v {
+			v[key] = r.field(item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = r.field(item)
+		}
+		return v
+	default:
+		return value
+	}
 }
@@ -0,0 +1,211 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/record"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// grpcEchoServer is an h2c gRPC server whose /test.Echo/Chat method answers
+// every message with its payload prefixed with "echo: ", and ends the call
+// with a trailer.
+func grpcEchoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(listen.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/test.Echo/Chat" {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "12")
+			w.Header().Set("Grpc-Message", "unknown method")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Echo-Session", "42")
+		w.WriteHeader(http.StatusOK)
+		for {
+			compressed, data, err := store.ReadGRPCFrame(req.Body)
+			if err != nil {
+				break
+			}
+			w.Write(store.FormatGRPCFrame(compressed, append([]byte("echo: "), data...)))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"X-Echo-Count", "2")
+	})))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// h2cClient is an HTTP/2 client with prior knowledge, without TLS.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+// startGRPCCall starts a streaming gRPC call with a first "hello" message,
+// whose next client messages are sent by writing frames to the returned writer.
+func startGRPCCall(t *testing.T, serverURL string, method string) (*io.PipeWriter, *http.Response) {
+	return startGRPCCallWith(t, serverURL, method, []byte("hello"))
+}
+
+// startGRPCCallWith starts a streaming gRPC call with the given first message.
+func startGRPCCallWith(t *testing.T, serverURL string, method string, first []byte) (*io.PipeWriter, *http.Response) {
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequest("POST", serverURL+method, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Test-Name", "grpc-e2e")
+	req.Header.Set("Grpc-Timeout", "10S")
+	respChan := make(chan *http.Response, 1)
+	go func() {
+		resp, err := h2cClient().Do(req)
+		if err != nil {
+			bodyWriter.CloseWithError(err)
+			respChan <- nil
+			return
+		}
+		respChan <- resp
+	}()
+	// The request is only sent once the first message is written.
+	_, err = bodyWriter.Write(store.FormatGRPCFrame(false, first))
+	require.NoError(t, err)
+	resp := <-respChan
+	require.NotNil(t, resp)
+	t.Cleanup(func() { resp.Body.Close() })
+	return bodyWriter, resp
+}
+
+// runGRPCChat runs a bidirectional streaming call, interleaving client and
+// server messages.
+func runGRPCChat(t *testing.T, serverURL string) {
+	bodyWriter, resp := startGRPCCall(t, serverURL, "/test.Echo/Chat")
+	require.Equal(t, 2, resp.ProtoMajor)
+	require.Equal(t, "42", resp.Header.Get("X-Echo-Session"))
+
+	compressed, data, err := store.ReadGRPCFrame(resp.Body)
+	require.NoError(t, err)
+	require.False(t, compressed)
+	require.Equal(t, "echo: hello", string(data))
+
+	_, err = bodyWriter.Write(store.FormatGRPCFrame(false, []byte{0x00, 0xff}))
+	require.NoError(t, err)
+	_, data, err = store.ReadGRPCFrame(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "echo: \x00\xff", string(data))
+
+	require.NoError(t, bodyWriter.Close())
+	_, _, err = store.ReadGRPCFrame(resp.Body)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	require.Equal(t, "2", resp.Trailer.Get("X-Echo-Count"))
+}
+
+func TestGRPC_RecordAndReplay(t *testing.T) {
+	upstream := grpcEchoServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		Type:       config.EndpointTypeGRPC,
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+		OnMiss:     config.MissConfig{StatusCode: http.StatusNotFound},
+	}
+	recordingDir := t.TempDir()
+
+	proxy := httptest.NewServer(listen.Handler(record.NewRecordingGRPCProxy(cfg, recordingDir, nil, nil)))
+	defer proxy.Close()
+	runGRPCChat(t, proxy.URL)
+
+	bodyWriter, resp := startGRPCCall(t, proxy.URL, "/test.Echo/Unknown")
+	require.NoError(t, bodyWriter.Close())
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "12", resp.Header.Get("Grpc-Status"), "trailers-only responses should be forwarded")
+
+	buf, err := os.ReadFile(filepath.Join(recordingDir, "grpc-e2e.grpc.json"))
+	require.NoError(t, err)
+	recording, err := store.ParseGRPCRecording(buf)
+	require.NoError(t, err)
+	require.Len(t, recording.Calls, 2)
+	chat := recording.Calls[0]
+	require.Equal(t, "/test.Echo/Chat", chat.Request.URL)
+	require.NotContains(t, chat.Request.Headers, "Grpc-Timeout")
+	var directions []string
+	for _, message := range chat.Messages {
+		directions = append(directions, message.Direction)
+	}
+	require.Equal(t, []string{"client", "server", "client", "server"}, directions)
+	require.Equal(t, store.GRPCStatus{Code: 0}, chat.Status)
+	require.Equal(t, map[string]string{"X-Echo-Count": "2"}, chat.Trailers)
+	require.Equal(t, store.GRPCStatus{Code: 12, Message: "unknown method"}, recording.Calls[1].Status)
+
+	// Replay without the upstream server.
+	upstream.Close()
+	replay := httptest.NewServer(listen.Handler(NewReplayGRPCServer(cfg, recordingDir, nil, nil)))
+	defer replay.Close()
+	runGRPCChat(t, replay.URL)
+
+	bodyWriter, resp = startGRPCCall(t, replay.URL, "/test.Echo/Unknown")
+	require.NoError(t, bodyWriter.Close())
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "12", resp.Header.Get("Grpc-Status"), "calls without server messages should be replayed trailers-only")
+	require.Equal(t, "unknown method", resp.Header.Get("Grpc-Message"))
+
+	// A client message that differs from the recording ends the call.
+	bodyWriter, resp = startGRPCCall(t, replay.URL, "/test.Echo/Chat")
+	_, _, err = store.ReadGRPCFrame(resp.Body)
+	require.NoError(t, err)
+	_, err = bodyWriter.Write(store.FormatGRPCFrame(false, []byte("other")))
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "13", resp.Trailer.Get("Grpc-Status"))
+	require.Equal(t, "message 2 mismatch: the message differs from the recorded one, 2 bytes recorded and 5 received", resp.Trailer.Get("Grpc-Message"))
+
+	// Calls that were not recorded are answered with the on_miss status.
+	bodyWriter, resp = startGRPCCall(t, replay.URL, "/test.Echo/Other")
+	require.NoError(t, bodyWriter.Close())
+	require.Equal(t, "true", resp.Header.Get(MissHeader))
+	require.Equal(t, "5", resp.Header.Get("Grpc-Status"))
+}
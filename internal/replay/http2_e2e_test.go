@@ -0,0 +1,164 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/record"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+// postGreeting sends the test request with client and returns the response
+// body.
+func postGreeting(t *testing.T, client *http.Client, serverURL string, expectedProto int) string {
+	req, err := http.NewRequest("POST", serverURL+"/v1/greet?lang=en", strings.NewReader(`{"name":"test"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Test-Name", "http2-e2e")
+	// The HTTP/1.1 and HTTP/2 clients have different default user agents.
+	req.Header.Set("User-Agent", "test-client")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, expectedProto, resp.ProtoMajor)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(MissHeader))
+	require.Empty(t, resp.Header.Get("Connection"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestHTTP2_RecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Connection", "keep-alive")
+		w.Write([]byte(`{"greeting":"hello"}`))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+	}
+	recordingDir := t.TempDir()
+
+	// Record over HTTP/1.1 and HTTP/2, which both forward the same request.
+	proxy := httptest.NewServer(listen.Handler(record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)))
+	defer proxy.Close()
+	require.Equal(t, `{"greeting":"hello"}`, postGreeting(t, http.DefaultClient, proxy.URL, 1))
+	require.Equal(t, `{"greeting":"hello"}`, postGreeting(t, h2cClient(), proxy.URL, 2))
+
+	// Replay the HTTP/1.1 recording over HTTP/2, without the upstream server.
+	upstream.Close()
+	replay := httptest.NewServer(listen.Handler(NewReplayHTTPServer(cfg, recordingDir, nil, nil)))
+	defer replay.Close()
+	require.Equal(t, `{"greeting":"hello"}`, postGreeting(t, h2cClient(), replay.URL, 2))
+	require.Equal(t, `{"greeting":"hello"}`, postGreeting(t, http.DefaultClient, replay.URL, 1))
+}
+
+// getChecksum sends a request whose response has a custom status text and a
+// trailer, and checks the response.
+func getChecksum(t *testing.T, client *http.Client, serverURL string, expectedStatus string) {
+	req, err := http.NewRequest("GET", serverURL+"/v1/checksum", nil)
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "trailers-e2e")
+	req.Header.Set("User-Agent", "test-client")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, expectedStatus, resp.Status)
+	require.Empty(t, resp.Header.Get(MissHeader))
+	require.Equal(t, `{"status":"checked"}`, string(body))
+	require.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestTrailers_RecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body := `{"status":"checked"}`
+		buf.WriteString("HTTP/1.1 202 Checked\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n")
+		buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\nX-Checksum: abc\r\n\r\n")
+		buf.Flush()
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+	}
+	recordingDir := t.TempDir()
+
+	proxy := httptest.NewServer(listen.Handler(record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)))
+	defer proxy.Close()
+	getChecksum(t, http.DefaultClient, proxy.URL, "202 Accepted")
+
+	buf, err := os.ReadFile(filepath.Join(recordingDir, "trailers-e2e.json"))
+	require.NoError(t, err)
+	var recordFile store.RecordFile
+	require.NoError(t, json.Unmarshal(buf, &recordFile))
+	require.Len(t, recordFile.Interactions, 1)
+	response := recordFile.Interactions[0].Response
+	require.Equal(t, "Checked", response.Status)
+	require.Equal(t, map[string]string{"X-Checksum": "abc"}, response.Trailers)
+
+	// Replay over HTTP/1.1 and HTTP/2, which has no status text. The recorded
+	// status text is only sent with send_status_text.
+	upstream.Close()
+	sendStatusText := *cfg
+	sendStatusText.SendStatusText = true
+	for _, tc := range []struct {
+		cfg            *config.EndpointConfig
+		client         *http.Client
+		expectedStatus string
+	}{
+		{cfg: cfg, client: http.DefaultClient, expectedStatus: "202 Accepted"},
+		{cfg: &sendStatusText, client: http.DefaultClient, expectedStatus: "202 Checked"},
+		{cfg: &sendStatusText, client: h2cClient(), expectedStatus: "202 Accepted"},
+	} {
+		replay := httptest.NewServer(listen.Handler(NewReplayHTTPServer(tc.cfg, recordingDir, nil, nil)))
+		getChecksum(t, tc.client, replay.URL, tc.expectedStatus)
+		replay.Close()
+	}
+}
@@ -0,0 +1,328 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/record"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// structBytes encodes fields as a google.protobuf.Struct message.
+func structBytes(t *testing.T, fields map[string]any) []byte {
+	message, err := structpb.NewStruct(fields)
+	require.NoError(t, err)
+	buf, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	require.NoError(t, err)
+	return buf
+}
+
+// parseStruct decodes a google.protobuf.Struct message.
+func parseStruct(t *testing.T, data []byte) map[string]any {
+	var message structpb.Struct
+	require.NoError(t, proto.Unmarshal(data, &message))
+	return message.AsMap()
+}
+
+// writeStructDescriptorSet writes the descriptor set of google.protobuf.Struct
+// and returns its path.
+func writeStructDescriptorSet(t *testing.T) string {
+	return writeDescriptorSet(t, structpb.File_google_protobuf_struct_proto)
+}
+
+// writeDescriptorSet writes the descriptor set of a file without imports and
+// returns its path.
+func writeDescriptorSet(t *testing.T, file protoreflect.FileDescriptor) string {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(file),
+	}}
+	buf, err := proto.Marshal(set)
+	require.NoError(t, err)
+	descriptorSet := filepath.Join(t.TempDir(), "descriptors.pb")
+	require.NoError(t, os.WriteFile(descriptorSet, buf, 0644))
+	return descriptorSet
+}
+
+// protoEchoServer answers Struct requests, over HTTP on /v1/echo and over gRPC
+// on /test.Echo/Say, with a Struct replying to their text field.
+func protoEchoServer(t *testing.T) *httptest.Server {
+	reply := func(data []byte) []byte {
+		return structBytes(t, map[string]any{"reply": "hi " + parseStruct(t, data)["text"].(string)})
+	}
+	server := httptest.NewServer(listen.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/echo" {
+			body, _ := io.ReadAll(req.Body)
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(reply(body))
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		_, data, err := store.ReadGRPCFrame(req.Body)
+		if err == nil {
+			w.Write(store.FormatGRPCFrame(false, reply(data)))
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProtoBodies_RecordAndReplay(t *testing.T) {
+	upstream := protoEchoServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+
+	descriptorSet := writeStructDescriptorSet(t)
+
+	httpConfig := &config.EndpointConfig{
+		TargetType:         "http",
+		TargetHost:         upstreamURL.Hostname(),
+		TargetPort:         port,
+		ProtoDescriptorSet: descriptorSet,
+		ProtoMessages: []config.ProtoMessage{
+			{Path: "/v1/echo", Request: "google.protobuf.Struct", Response: "google.protobuf.Struct"},
+		},
+	}
+	grpcConfig := *httpConfig
+	grpcConfig.Type = config.EndpointTypeGRPC
+	grpcConfig.RedactJSONPaths = jsonpath.MustParseAll("token")
+	grpcConfig.ProtoMessages = []config.ProtoMessage{
+		{Path: "/test.Echo/*", Request: "google.protobuf.Struct", Response: "google.protobuf.Struct"},
+	}
+	recordingDir := t.TempDir()
+
+	postEcho := func(serverURL string) map[string]any {
+		req, err := http.NewRequest("POST", serverURL+"/v1/echo", bytes.NewReader(structBytes(t, map[string]any{"text": "hello"})))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Test-Name", "proto-e2e")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return parseStruct(t, body)
+	}
+	say := func(serverURL string, token string) map[string]any {
+		bodyWriter, resp := startGRPCCallWith(t, serverURL, "/test.Echo/Say", structBytes(t, map[string]any{"text": "hello", "token": token}))
+		require.NoError(t, bodyWriter.Close())
+		_, data, err := store.ReadGRPCFrame(resp.Body)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		return parseStruct(t, data)
+	}
+
+	httpProxy := record.NewRecordingHTTPSProxy(httpConfig, recordingDir, nil, nil)
+	require.NoError(t, httpProxy.LoadProtoDescriptors())
+	grpcProxy := record.NewRecordingGRPCProxy(&grpcConfig, recordingDir, nil, nil)
+	require.NoError(t, grpcProxy.LoadProtoDescriptors())
+	httpRecord := httptest.NewServer(httpProxy)
+	defer httpRecord.Close()
+	grpcRecord := httptest.NewServer(listen.Handler(grpcProxy))
+	defer grpcRecord.Close()
+	require.Equal(t, map[string]any{"reply": "hi hello"}, postEcho(httpRecord.URL))
+	require.Equal(t, map[string]any{"reply": "hi hello"}, say(grpcRecord.URL, "secret-1"))
+
+	buf, err := os.ReadFile(filepath.Join(recordingDir, "proto-e2e.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"text": "hello"`, "protobuf request bodies should be recorded as JSON")
+	require.Contains(t, string(buf), `"reply": "hi hello"`, "protobuf response bodies should be recorded as JSON")
+	buf, err = os.ReadFile(filepath.Join(recordingDir, "grpc-e2e.grpc.json"))
+	require.NoError(t, err)
+	recording, err := store.ParseGRPCRecording(buf)
+	require.NoError(t, err)
+	messages := recording.Calls[0].Messages
+	require.JSONEq(t, `{"text":"hello","token":"REDACTED"}`, string(messages[0].Message))
+	require.JSONEq(t, `{"reply":"hi hello"}`, string(messages[1].Message))
+
+	// Replay without the upstream server, the token is redacted before the
+	// client message is compared.
+	upstream.Close()
+	httpServer := NewReplayHTTPServer(httpConfig, recordingDir, nil, nil)
+	require.NoError(t, httpServer.LoadProtoDescriptors())
+	grpcServer := NewReplayGRPCServer(&grpcConfig, recordingDir, nil, nil)
+	require.NoError(t, grpcServer.LoadProtoDescriptors())
+	httpReplay := httptest.NewServer(httpServer)
+	defer httpReplay.Close()
+	grpcReplay := httptest.NewServer(listen.Handler(grpcServer))
+	defer grpcReplay.Close()
+	require.Equal(t, map[string]any{"reply": "hi hello"}, postEcho(httpReplay.URL))
+	require.Equal(t, map[string]any{"reply": "hi hello"}, say(grpcReplay.URL, "secret-2"))
+
+	// The mismatch ends the call with a trailers-only response.
+	_, resp := startGRPCCallWith(t, grpcReplay.URL, "/test.Echo/Say", structBytes(t, map[string]any{"text": "bye"}))
+	require.Equal(t, "13", resp.Header.Get("Grpc-Status"))
+	require.Contains(t, resp.Header.Get("Grpc-Message"), `text: recorded "hello", got "bye"`)
+}
+
+func TestProtoBodies_KeepsInexactBodies(t *testing.T) {
+	// The response has an unknown field 99, which JSON cannot hold.
+	responseBody := append(structBytes(t, map[string]any{"reply": "hi"}), 0x98, 0x06, 0x01)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(responseBody)
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType:         "http",
+		TargetHost:         upstreamURL.Hostname(),
+		TargetPort:         port,
+		ProtoDescriptorSet: writeStructDescriptorSet(t),
+		ProtoMessages: []config.ProtoMessage{
+			{Path: "/v1/echo", Request: "google.protobuf.Struct", Response: "google.protobuf.Struct"},
+		},
+	}
+	recordingDir := t.TempDir()
+
+	// The request body is not a valid Struct message.
+	requestBody := []byte{0xff, 0xff}
+	post := func(serverURL string) []byte {
+		req, err := http.NewRequest("POST", serverURL+"/v1/echo", bytes.NewReader(requestBody))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Test-Name", "proto-inexact")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return body
+	}
+
+	proxy := record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)
+	require.NoError(t, proxy.LoadProtoDescriptors())
+	recordServer := httptest.NewServer(proxy)
+	defer recordServer.Close()
+	require.Equal(t, responseBody, post(recordServer.URL))
+
+	buf, err := os.ReadFile(filepath.Join(recordingDir, "proto-inexact.json"))
+	require.NoError(t, err)
+	var recordFile store.RecordFile
+	require.NoError(t, json.Unmarshal(buf, &recordFile))
+	interaction := recordFile.Interactions[0]
+	require.Equal(t, base64.StdEncoding.EncodeToString(requestBody), interaction.Request.BodyBase64)
+	require.Empty(t, interaction.Request.BodySegments)
+	require.Equal(t, base64.StdEncoding.EncodeToString(responseBody), interaction.Response.BodyBase64)
+	require.Empty(t, interaction.Response.BodySegments)
+
+	upstream.Close()
+	replayServer := NewReplayHTTPServer(cfg, recordingDir, nil, nil)
+	require.NoError(t, replayServer.LoadProtoDescriptors())
+	replay := httptest.NewServer(replayServer)
+	defer replay.Close()
+	require.Equal(t, responseBody, post(replay.URL), "replay should send the exact recorded bytes")
+}
+
+func TestProtoBodies_RedactedEnum(t *testing.T) {
+	responseBody, err := proto.Marshal(&descriptorpb.FieldDescriptorProto{
+		Name: proto.String("id"),
+		Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(),
+	})
+	require.NoError(t, err)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(responseBody)
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType:         "http",
+		TargetHost:         upstreamURL.Hostname(),
+		TargetPort:         port,
+		ProtoDescriptorSet: writeDescriptorSet(t, descriptorpb.File_google_protobuf_descriptor_proto),
+		ProtoMessages: []config.ProtoMessage{
+			{Path: "/v1/field", Response: "google.protobuf.FieldDescriptorProto"},
+		},
+	}
+	get := func(serverURL string) *http.Response {
+		req, err := http.NewRequest("GET", serverURL+"/v1/field", nil)
+		require.NoError(t, err)
+		req.Header.Set("Test-Name", "proto-enum")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	recordingDir := t.TempDir()
+	recordingPath := filepath.Join(recordingDir, "proto-enum.json")
+
+	// The enum redacted to a string placeholder cannot be encoded, so the
+	// response is not recorded.
+	redactEnum := *cfg
+	redactEnum.RedactJSONPaths = jsonpath.MustParseAll("type")
+	proxy := record.NewRecordingHTTPSProxy(&redactEnum, recordingDir, nil, nil)
+	require.NoError(t, proxy.LoadProtoDescriptors())
+	recordServer := httptest.NewServer(proxy)
+	defer recordServer.Close()
+	get(recordServer.URL)
+	_, err = os.Stat(recordingPath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// A recording that cannot be encoded is answered with an error.
+	proxy = record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)
+	require.NoError(t, proxy.LoadProtoDescriptors())
+	recordServer = httptest.NewServer(proxy)
+	defer recordServer.Close()
+	get(recordServer.URL)
+	buf, err := os.ReadFile(recordingPath)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"TYPE_INT64"`)
+	buf = bytes.Replace(buf, []byte(`"TYPE_INT64"`), []byte(`"REDACTED"`), 1)
+	require.NoError(t, os.WriteFile(recordingPath, buf, 0644))
+
+	upstream.Close()
+	replayServer := NewReplayHTTPServer(cfg, recordingDir, nil, nil)
+	require.NoError(t, replayServer.LoadProtoDescriptors())
+	replay := httptest.NewServer(replayServer)
+	defer replay.Close()
+	require.Equal(t, http.StatusInternalServerError, get(replay.URL).StatusCode)
+}
@@ -20,12 +20,19 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/google/test-server/internal/authemu"
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
 )
 
+// replayServer is a server replaying the recorded traffic of an endpoint.
+type replayServer interface {
+	Start() error
+}
+
 // Replay serves recorded responses for HTTP requests
-func Replay(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact) error {
+func Replay(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) error {
 	// Validate recording directory exists
 	if _, err := os.Stat(recordingDir); os.IsNotExist(err) {
 		return fmt.Errorf("recording directory does not exist: %s", recordingDir)
@@ -33,18 +40,39 @@ func Replay(cfg *config.TestServerConfig, recordingDir string, redactor *redact.
 
 	fmt.Printf("Replaying from directory: %s\n", recordingDir)
 
+	// Load the descriptor sets before starting any server, so that a missing
+	// file fails fast.
+	servers := make([]replayServer, len(cfg.Endpoints))
+	for i := range cfg.Endpoints {
+		switch cfg.Endpoints[i].Type {
+		case config.EndpointTypeAuthEmulator:
+			servers[i] = authemu.NewServer(&cfg.Endpoints[i])
+			continue
+		case config.EndpointTypeGRPC:
+			grpcServer := NewReplayGRPCServer(&cfg.Endpoints[i], recordingDir, redactor, reporter)
+			if err := grpcServer.LoadProtoDescriptors(); err != nil {
+				return err
+			}
+			servers[i] = grpcServer
+		default:
+			httpServer := NewReplayHTTPServer(&cfg.Endpoints[i], recordingDir, redactor, reporter)
+			if err := httpServer.LoadProtoDescriptors(); err != nil {
+				return err
+			}
+			servers[i] = httpServer
+		}
+	}
+
 	// Start a server for each endpoint
 	errChan := make(chan error, len(cfg.Endpoints))
 
-	for _, endpoint := range cfg.Endpoints {
-		go func(ep config.EndpointConfig) {
-			server := NewReplayHTTPServer(&endpoint, recordingDir, redactor)
-			err := server.Start()
-			if err != nil {
+	for i, endpoint := range cfg.Endpoints {
+		go func(ep config.EndpointConfig, server replayServer) {
+			if err := server.Start(); err != nil {
 				errChan <- fmt.Errorf("replay error for %s:%d: %w",
 					ep.TargetHost, ep.TargetPort, err)
 			}
-		}(endpoint)
+		}(endpoint, servers[i])
 	}
 
 	// Return the first error encountered, if any
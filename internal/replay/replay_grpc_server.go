@@ -0,0 +1,303 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/protobody"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
+	"github.com/google/test-server/internal/store"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ReplayGRPCServer replays the gRPC calls recorded in <fileName>.grpc.json.
+type ReplayGRPCServer struct {
+	config       *config.EndpointConfig
+	recordingDir string
+	redactor     *redact.Redact
+	reporter     *report.Report
+	codec        *protobody.Codec
+	// calls counts the calls started per test and request, guarded by mu since
+	// calls are replayed concurrently.
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func NewReplayGRPCServer(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) *ReplayGRPCServer {
+	return &ReplayGRPCServer{
+		config:       cfg,
+		recordingDir: recordingDir,
+		redactor:     redactor,
+		reporter:     reporter,
+		calls:        make(map[string]int),
+	}
+}
+
+// LoadProtoDescriptors loads the proto_descriptor_set of the endpoint, to
+// replay protobuf bodies as JSON.
+func (r *ReplayGRPCServer) LoadProtoDescriptors() error {
+	codec, err := protobody.New(r.config)
+	if err != nil {
+		return err
+	}
+	r.codec = codec
+	return nil
+}
+
+func (r *ReplayGRPCServer) Start() error {
+	if err := listen.ListenAndServe(r.config, r); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// ServeHTTP replays the recorded gRPC call matching a request.
+func (r *ReplayGRPCServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == r.config.Health {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, fmt.Sprintf("Unsupported content type for a gRPC endpoint: %q", req.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	recReq := store.NewGRPCRequest(req, *r.config)
+	if err := recReq.Redact(r.config, r.redactor); err != nil {
+		fmt.Printf("Error processing gRPC call: %v\n", err)
+		writeGRPCStatus(w, store.GRPCCodeInternal, fmt.Sprintf("Error processing gRPC call: %v", err))
+		return
+	}
+	fmt.Printf("Replaying gRPC call: %s\n", recReq.Request)
+	fileName, err := recReq.GetRecordingFileName()
+	if err != nil {
+		fmt.Printf("Invalid recording file name: %v\n", err)
+		writeGRPCStatus(w, store.GRPCCodeInternal, fmt.Sprintf("Invalid recording file name: %v", err))
+		return
+	}
+
+	call, err := r.nextCall(fileName, recReq)
+	if err != nil {
+		r.reporter.Miss(fileName, recReq.Request)
+		fmt.Printf("Error loading gRPC call: %v\n", err)
+		r.writeMiss(w, fmt.Sprintf("Error loading gRPC call: %v", err))
+		return
+	}
+	r.reporter.Hit(fileName, "")
+	r.replayCall(w, req, call)
+}
+
+// nextCall returns the next recorded call of the test matching the given
+// request. Once all the matching calls were replayed, they are replayed again
+// from the first one.
+func (r *ReplayGRPCServer) nextCall(fileName string, req *store.RecordedRequest) (*store.GRPCCall, error) {
+	responseFile := filepath.Join(r.recordingDir, fileName+".grpc.json")
+	fmt.Printf("loading gRPC calls from : %s\n", responseFile)
+	buf, err := os.ReadFile(responseFile)
+	if err != nil {
+		return nil, err
+	}
+	r.reporter.Loaded(fileName, responseFile, nil)
+	recording, err := store.ParseGRPCRecording(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", responseFile, err)
+	}
+
+	var matching []*store.GRPCCall
+	for _, call := range recording.Calls {
+		if call.Matches(req) {
+			matching = append(matching, call)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no recorded gRPC call of %s matches the request: %s", fileName, req.Request)
+	}
+
+	key := fileName + " " + store.GRPCCallSum(req)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call := matching[r.calls[key]%len(matching)]
+	r.calls[key]++
+	return call, nil
+}
+
+// replayCall replays the messages of the call in their recorded order: client
+// messages are read from the request and checked against the recorded ones,
+// and server messages are sent once the client messages preceding them were
+// received. The response headers are sent with the first server message, so
+// that calls without server messages end with a trailers-only response.
+func (r *ReplayGRPCServer) replayCall(w http.ResponseWriter, req *http.Request, call *store.GRPCCall) {
+	requestType, responseType := r.codec.Types(req.URL.Path)
+	headerWritten := false
+	writeHeader := func() {
+		if headerWritten {
+			return
+		}
+		headerWritten = true
+		w.Header().Set("Content-Type", "application/grpc")
+		if call.Response != nil {
+			for name, value := range call.Response.Headers {
+				w.Header().Set(name, value)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	end := func(trailer http.Header) {
+		prefix := http.TrailerPrefix
+		if !headerWritten {
+			prefix = ""
+		}
+		for name, values := range trailer {
+			w.Header()[prefix+name] = values
+		}
+		writeHeader()
+	}
+
+	for i, message := range call.Messages {
+		if message.Direction == store.DirectionClient {
+			if err := r.checkClientMessage(req.Body, message, requestType); err != nil {
+				fmt.Printf("gRPC message %d mismatch: %v\n", i, err)
+				end(grpcStatus(store.GRPCCodeInternal, fmt.Sprintf("message %d mismatch: %v", i, err)))
+				return
+			}
+			continue
+		}
+		data, err := messageBytes(message, responseType)
+		if err != nil {
+			end(grpcStatus(store.GRPCCodeInternal, fmt.Sprintf("message %d: %v", i, err)))
+			return
+		}
+		writeHeader()
+		if _, err := w.Write(store.FormatGRPCFrame(message.Compressed, data)); err != nil {
+			fmt.Printf("Error writing gRPC message: %v\n", err)
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	end(call.StatusTrailers())
+}
+
+// checkClientMessage reads the next client message and checks it against the
+// recorded one. Messages recorded as JSON are compared as JSON, once redacted
+// like the recorded ones.
+func (r *ReplayGRPCServer) checkClientMessage(body io.Reader, recorded *store.GRPCMessage, messageType protoreflect.MessageDescriptor) error {
+	compressed, received, err := store.ReadGRPCFrame(body)
+	if err == io.EOF {
+		return fmt.Errorf("the client ended the call")
+	}
+	if err != nil {
+		return err
+	}
+	if compressed != recorded.Compressed {
+		return fmt.Errorf("compressed: recorded %t, got %t", recorded.Compressed, compressed)
+	}
+	if len(recorded.Message) == 0 {
+		data, err := recorded.Bytes()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(received, data) {
+			return fmt.Errorf("the message differs from the recorded one, %d bytes recorded and %d received", len(data), len(received))
+		}
+		return nil
+	}
+
+	if messageType == nil {
+		return fmt.Errorf("no message type is known to decode the message")
+	}
+	decoded, err := protobody.ToJSON(messageType, received)
+	if err != nil {
+		return fmt.Errorf("failed decoding %s: %w", messageType.FullName(), err)
+	}
+	receivedMessage := &store.GRPCMessage{Direction: store.DirectionClient, Message: decoded}
+	if err := receivedMessage.Redact(r.config, r.redactor); err != nil {
+		return err
+	}
+	if diffs := diffJSONMessage(recorded.Message, receivedMessage.Message, nil); len(diffs) > 0 {
+		return fmt.Errorf("%s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// messageBytes returns the binary message, encoding messages recorded as JSON
+// with the given message type.
+func messageBytes(message *store.GRPCMessage, messageType protoreflect.MessageDescriptor) ([]byte, error) {
+	if len(message.Message) == 0 {
+		return message.Bytes()
+	}
+	if messageType == nil {
+		return nil, fmt.Errorf("no message type is known to encode the message")
+	}
+	return protobody.FromJSON(messageType, message.Message)
+}
+
+// writeMiss answers a gRPC call that has no recording, with the gRPC code of
+// the on_miss status code.
+func (r *ReplayGRPCServer) writeMiss(w http.ResponseWriter, errMsg string) {
+	message := errMsg
+	if r.config.OnMiss.Message != "" {
+		message = r.config.OnMiss.Message
+	}
+	w.Header().Set(MissHeader, "true")
+	writeGRPCStatus(w, grpcCode(r.config.OnMiss.StatusCode), message)
+}
+
+// writeGRPCStatus ends a call with the given status, in a trailers-only
+// response.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	for name, values := range grpcStatus(code, message) {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func grpcStatus(code int, message string) http.Header {
+	return (&store.GRPCCall{Status: store.GRPCStatus{Code: code, Message: message}}).StatusTrailers()
+}
+
+// grpcCode maps an HTTP status code to the canonical gRPC status code, as
+// googleStatus maps it to its name.
+func grpcCode(statusCode int) int {
+	codes := map[string]int{
+		"CANCELLED":          1,
+		"INVALID_ARGUMENT":   3,
+		"DEADLINE_EXCEEDED":  4,
+		"NOT_FOUND":          5,
+		"PERMISSION_DENIED":  7,
+		"RESOURCE_EXHAUSTED": 8,
+		"ABORTED":            10,
+		"UNIMPLEMENTED":      12,
+		"INTERNAL":           13,
+		"UNAVAILABLE":        14,
+		"UNAUTHENTICATED":    16,
+	}
+	return codes[googleStatus(statusCode)]
+}
@@ -18,47 +18,72 @@ package replay
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"unicode"
+	"sync"
 
 	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/protobody"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/report"
 	"github.com/google/test-server/internal/store"
 	"github.com/gorilla/websocket"
 )
 
+// MissHeader is set on responses replay sends when no recording matches a request.
+const MissHeader = "X-Test-Server-Miss"
+
 type ReplayHTTPServer struct {
 	prevRequestSHA string
 	seenFiles      map[string]struct{}
 	config         *config.EndpointConfig
 	recordingDir   string
 	redactor       *redact.Redact
+	reporter       *report.Report
+	codec          *protobody.Codec
+	// websocketSessions counts the connections opened per test and handshake,
+	// guarded by websocketMu since connections are replayed concurrently.
+	websocketMu       sync.Mutex
+	websocketSessions map[string]int
 }
 
-func NewReplayHTTPServer(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact) *ReplayHTTPServer {
+func NewReplayHTTPServer(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact, reporter *report.Report) *ReplayHTTPServer {
 	return &ReplayHTTPServer{
-		prevRequestSHA: store.HeadSHA,
-		seenFiles:      make(map[string]struct{}),
-		config:         cfg,
-		recordingDir:   recordingDir,
-		redactor:       redactor,
+		prevRequestSHA:    store.HeadSHA,
+		seenFiles:         make(map[string]struct{}),
+		config:            cfg,
+		recordingDir:      recordingDir,
+		redactor:          redactor,
+		reporter:          reporter,
+		websocketSessions: make(map[string]int),
 	}
 }
 
-func (r *ReplayHTTPServer) Start() error {
-	addr := fmt.Sprintf(":%d", r.config.SourcePort)
-	server := &http.Server{
-		Addr:    addr,
-		Handler: http.HandlerFunc(r.handleRequest),
+// ServeHTTP replays the recorded response of a request.
+func (r *ReplayHTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handleRequest(w, req)
+}
+
+// LoadProtoDescriptors loads the proto_descriptor_set of the endpoint, to
+// replay protobuf bodies as JSON.
+func (r *ReplayHTTPServer) LoadProtoDescriptors() error {
+	codec, err := protobody.New(r.config)
+	if err != nil {
+		return err
 	}
-	if err := server.ListenAndServe(); err != nil {
+	r.codec = codec
+	return nil
+}
+
+func (r *ReplayHTTPServer) Start() error {
+	if err := listen.ListenAndServe(r.config, http.HandlerFunc(r.handleRequest)); err != nil {
 		panic(err)
 	}
 	return nil
@@ -90,26 +115,37 @@ func (r *ReplayHTTPServer) handleRequest(w http.ResponseWriter, req *http.Reques
 	if req.Header.Get("Upgrade") == "websocket" {
 		fmt.Printf("Upgrading connection to websocket...\n")
 
-		chunks, err := r.loadWebsocketChunks(fileName)
+		session, err := r.nextWebsocketSession(fileName, redactedReq)
 		if err != nil {
+			r.reporter.Miss(fileName, redactedReq.Request)
 			fmt.Printf("Error loading websocket response: %v\n", err)
-			http.Error(w, fmt.Sprintf("Error loading websocket response: %v", err), http.StatusInternalServerError)
+			r.writeMiss(w, fmt.Sprintf("Error loading websocket response: %v", err))
 			return
 		}
+		r.reporter.Hit(fileName, "")
 		fmt.Printf("Replaying websocket: %s\n", fileName)
-		r.proxyWebsocket(w, req, chunks)
+		r.proxyWebsocket(w, req, session)
 		return
 	}
 	fmt.Printf("Replaying http request: %s\n", redactedReq.Request)
 	shaSum := redactedReq.ComputeSum()
 	resp, err := r.loadResponse(fileName, shaSum)
 	if err != nil {
+		r.reporter.Miss(fileName, redactedReq.Request)
 		fmt.Printf("Error loading response: %v\n", err)
-		http.Error(w, fmt.Sprintf("Error loading response: %v", err), http.StatusInternalServerError)
+		r.writeMiss(w, fmt.Sprintf("Error loading response: %v", err))
 		return
 	}
 
-	err = r.writeResponse(w, resp, redactedReq)
+	body, err := r.responseBody(resp, redactedReq)
+	if err != nil {
+		fmt.Printf("Error loading response body: %v\n", err)
+		http.Error(w, fmt.Sprintf("Error loading response body: %v", err), http.StatusInternalServerError)
+		return
+	}
+	r.reporter.Hit(fileName, shaSum)
+
+	err = r.writeResponse(w, req, resp, body)
 	if err != nil {
 		fmt.Printf("Error writing response: %v\n", err)
 		panic(err)
@@ -121,22 +157,15 @@ func (r *ReplayHTTPServer) handleRequest(w http.ResponseWriter, req *http.Reques
 }
 
 func (r *ReplayHTTPServer) createRedactedRequest(req *http.Request) (*store.RecordedRequest, error) {
-	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config)
+	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config, r.codec)
 	if err != nil {
 		return nil, err
 	}
 
-	// Redact headers by key
-	recordedRequest.RedactHeaders(r.config.RedactRequestHeaders)
-	// Redacts secrets from header values
-	r.redactor.Headers(recordedRequest.Headers)
-	recordedRequest.Request = r.redactor.String(recordedRequest.Request)
-	recordedRequest.URL = r.redactor.String(recordedRequest.URL)
-	var redactedBodySegments []map[string]any
-	for _, bodySegment := range recordedRequest.BodySegments {
-		redactedBodySegments = append(redactedBodySegments, r.redactor.Map(bodySegment))
+	err = recordedRequest.Redact(r.config, r.redactor)
+	if err != nil {
+		return nil, err
 	}
-	recordedRequest.BodySegments = redactedBodySegments
 	return recordedRequest, nil
 }
 
@@ -161,6 +190,12 @@ func (r *ReplayHTTPServer) loadResponse(fileName string, shaSum string) (*store.
 		return nil, fmt.Errorf("unable to deserialize data to RecordFile: %w", err)
 	}
 
+	shaSums := make([]string, 0, len(recordFile.Interactions))
+	for _, interaction := range recordFile.Interactions {
+		shaSums = append(shaSums, interaction.SHASum)
+	}
+	r.reporter.Loaded(fileName, filePath, shaSums)
+
 	for _, interaction := range recordFile.Interactions {
 		if interaction.SHASum == shaSum {
 			return interaction.Response, nil
@@ -170,160 +205,205 @@ func (r *ReplayHTTPServer) loadResponse(fileName string, shaSum string) (*store.
 	return nil, fmt.Errorf("response with shaSum %s not found in file", shaSum)
 }
 
-func (r *ReplayHTTPServer) writeResponse(w http.ResponseWriter, resp *store.RecordedResponse, req *store.RecordedRequest) error {
+func (r *ReplayHTTPServer) writeResponse(w http.ResponseWriter, httpReq *http.Request, resp *store.RecordedResponse, body []byte) error {
 	for key, value := range resp.Headers {
-		if key == "Content-Length" || key == "Content-Encoding" {
+		if key == "Content-Length" || key == "Content-Encoding" || listen.IsConnectionHeader(key) {
 			continue
 		}
 		w.Header().Add(key, value)
 	}
 
-	w.WriteHeader(int(resp.StatusCode))
+	statusText := ""
+	if r.config.SendStatusText {
+		statusText = resp.Status
+	}
+	return listen.WriteResponse(w, httpReq, int(resp.StatusCode), statusText, body, resp.TrailerHeader())
+}
 
-	// When the response body is empty we return directly with the headers.
+// responseBody encodes the recorded body of a response.
+func (r *ReplayHTTPServer) responseBody(resp *store.RecordedResponse, req *store.RecordedRequest) ([]byte, error) {
+	// Protobuf bodies that could not be recorded as JSON are replayed as is.
+	if resp.BodyBase64 != "" {
+		body, err := base64.StdEncoding.DecodeString(resp.BodyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response body: %w", err)
+		}
+		return body, nil
+	}
+	// Responses without body are replayed with their headers only.
 	if len(resp.BodySegments) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	if !strings.Contains(req.URL, "alt=sse") {
+	path, _, _ := strings.Cut(req.URL, "?")
+	if _, responseType := r.codec.Types(path); responseType != nil && protobody.IsProtobuf(resp.Headers["Content-Type"]) {
 		jsonBytes, err := json.Marshal(resp.BodySegments[0])
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		_, err = w.Write(jsonBytes)
-		return err
-	} else {
-		for _, bodySegment := range resp.BodySegments {
-			jsonBytes, err := json.Marshal(bodySegment)
-			if err != nil {
-				return err
-			}
-
-			line := append([]byte("data: "), jsonBytes...)
-			line = append(line, []byte("\n\n")...)
-
-			if _, err := w.Write(line); err != nil {
-				return err
-			}
+		body, err := protobody.FromJSON(responseType, jsonBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed encoding %s body: %w", responseType.FullName(), err)
 		}
+		return body, nil
 	}
 
-	return nil
+	if !strings.Contains(req.URL, "alt=sse") {
+		return json.Marshal(resp.BodySegments[0])
+	}
+	var body []byte
+	for _, bodySegment := range resp.BodySegments {
+		jsonBytes, err := json.Marshal(bodySegment)
+		if err != nil {
+			return nil, err
+		}
+
+		body = append(body, []byte("data: ")...)
+		body = append(body, jsonBytes...)
+		body = append(body, []byte("\n\n")...)
+	}
+	return body, nil
 }
 
-func extractNumber(i *int, content string) (int, error) {
-	numStart := *i
-	for *i < len(content) && unicode.IsDigit(rune(content[*i])) {
-		*i++
+// writeMiss answers a request that has no recording, as configured by on_miss.
+func (r *ReplayHTTPServer) writeMiss(w http.ResponseWriter, errMsg string) {
+	statusCode := r.config.OnMiss.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
 	}
-	numEnd := *i
-	if numStart == numEnd {
-		return 0, fmt.Errorf("missing chunk length after prefix at position %d", numStart-1)
+	message := errMsg
+	if r.config.OnMiss.Message != "" {
+		message = r.config.OnMiss.Message
 	}
-	numStr := content[numStart:numEnd]
-	num, err := strconv.Atoi(numStr)
+
+	w.Header().Set(MissHeader, "true")
+	if r.config.OnMiss.Format != "google" {
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"code":    statusCode,
+			"message": message,
+			"status":  googleStatus(statusCode),
+		},
+	})
 	if err != nil {
-		return 0, fmt.Errorf("invalid chunk length '%s': %w", numStr, err)
+		http.Error(w, message, statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// googleStatus maps an HTTP status code to the canonical Google API error status.
+func googleStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusConflict:
+		return "ABORTED"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case 499:
+		return "CANCELLED"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	default:
+		return "INTERNAL"
 	}
-	return num, nil
 }
 
-func (r *ReplayHTTPServer) proxyWebsocket(w http.ResponseWriter, req *http.Request, chunks []string) {
-	clientConn, err := r.upgradeConnectionToWebsocket(w, req)
+func (r *ReplayHTTPServer) proxyWebsocket(w http.ResponseWriter, req *http.Request, session *store.WebsocketSession) {
+	clientConn, err := r.upgradeConnectionToWebsocket(w, req, session.Response)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error proxying websocket: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
-	r.replayWebsocket(clientConn, chunks)
+	r.replayWebsocket(clientConn, session.Frames)
 }
 
-func (r *ReplayHTTPServer) loadWebsocketChunks(fileName string) ([]string, error) {
-	responseFile := filepath.Join(r.recordingDir, fileName+".websocket.log")
-	fmt.Printf("loading websocket response from : %s\n", responseFile)
-	bytes, err := os.ReadFile(responseFile)
-	var chunks = make([]string, 0)
+// nextWebsocketSession returns the next recorded session of the test whose
+// handshake matches the given request. Once all the matching sessions were
+// replayed, they are replayed again from the first one.
+func (r *ReplayHTTPServer) nextWebsocketSession(fileName string, req *store.RecordedRequest) (*store.WebsocketSession, error) {
+	sessions, err := r.loadWebsocketSessions(fileName)
 	if err != nil {
-		fmt.Printf("Error loading websocket response: %v\n", err)
-		return chunks, err
+		return nil, err
 	}
-
-	i := 0
-	response := string(bytes)
-	for i < len(response) {
-		// Extracts prefix
-		prefix := response[i]
-		if prefix != '>' && prefix != '<' {
-			return nil, fmt.Errorf("invalid message prefix at position %d: expected '>' or '<', got '%c'", i, prefix)
+	var matching []*store.WebsocketSession
+	for _, session := range sessions {
+		if session.Matches(req) {
+			matching = append(matching, session)
 		}
-		i++ // Move cursor past prefix.
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no recorded websocket session of %s matches the handshake: %s", fileName, req.Request)
+	}
 
-		// Extracts chunk length number
-		num, err := extractNumber(&i, response)
-		i++ // Move cursor to skip the whitespace between the number and the actual chunk.
-		if err != nil {
-			return nil, fmt.Errorf("failed to extract number %v", err)
-		}
+	key := fileName + " " + store.HandshakeSum(req)
+	r.websocketMu.Lock()
+	defer r.websocketMu.Unlock()
+	session := matching[r.websocketSessions[key]%len(matching)]
+	r.websocketSessions[key]++
+	return session, nil
+}
 
-		// Extracts chunk
-		chunkStart := i
-		chunkEnd := chunkStart + num
-		if chunkEnd > len(response) {
-			return nil, fmt.Errorf("chunk length %d at position %d exceeds response bounds", chunkEnd, chunkStart)
-		}
-		chunk := response[chunkStart : chunkEnd-1] // Remove the \n appended at the end of the chunk
-		chunks = append(chunks, string(prefix)+chunk)
-		i = chunkEnd
+// loadWebsocketSessions loads the sessions of the <fileName>.websocket.json
+// recording, or of the legacy <fileName>.websocket.log recording.
+func (r *ReplayHTTPServer) loadWebsocketSessions(fileName string) ([]*store.WebsocketSession, error) {
+	responseFile := filepath.Join(r.recordingDir, fileName+".websocket.json")
+	bytes, err := os.ReadFile(responseFile)
+	if os.IsNotExist(err) {
+		return r.loadWebsocketLog(fileName)
 	}
-	return chunks, nil
-}
+	fmt.Printf("loading websocket response from : %s\n", responseFile)
+	if err != nil {
+		fmt.Printf("Error loading websocket response: %v\n", err)
+		return nil, err
+	}
+	r.reporter.Loaded(fileName, responseFile, nil)
 
-func (r *ReplayHTTPServer) replayWebsocket(conn *websocket.Conn, chunks []string) {
-	for _, chunk := range chunks {
-		if strings.HasPrefix(chunk, ">") {
-			_, buf, err := conn.ReadMessage()
-			reqChunk := r.redactor.String(string(buf))
-			if err != nil {
-				fmt.Printf("Error reading from websocket: %v\n", err)
-				return
-			}
-
-			runes := []rune(chunk)
-			recChunk := string(runes[1:])
-			if reqChunk != recChunk {
-				fmt.Printf("input chunk mismatch\n Input chunk: %s\n Recorded chunk: %s\n", reqChunk, recChunk)
-				writeError(conn, "input chunk mismatch")
-				return
-			}
-		} else if strings.HasPrefix(chunk, "<") {
-			runes := []rune(chunk)
-			recChunk := string(runes[1:])
-			// Write binary message. (messageType=2)
-			err := conn.WriteMessage(2, []byte(recChunk))
-			if err != nil {
-				fmt.Printf("Error writing to websocket: %v\n", err)
-				return
-			}
-		} else {
-			fmt.Printf("Unreconginized chunk: %s", chunk)
-			return
-		}
+	recording, err := store.ParseWebsocketRecording(bytes)
+	if err != nil {
+		return nil, err
 	}
+	return recording.Sessions, nil
 }
 
-func writeError(conn *websocket.Conn, errMsg string) {
-	closeMessage := websocket.FormatCloseMessage(
-		websocket.CloseInternalServerErr,
-		errMsg,
-	)
-	err := conn.WriteMessage(websocket.CloseMessage, closeMessage)
+func (r *ReplayHTTPServer) loadWebsocketLog(fileName string) ([]*store.WebsocketSession, error) {
+	responseFile := filepath.Join(r.recordingDir, fileName+".websocket.log")
+	fmt.Printf("loading websocket response from : %s\n", responseFile)
+	bytes, err := os.ReadFile(responseFile)
 	if err != nil {
-		fmt.Printf("Failed to write error: %v\n", err)
+		fmt.Printf("Error loading websocket response: %v\n", err)
+		return nil, err
 	}
+	r.reporter.Loaded(fileName, responseFile, nil)
+
+	chunks, err := store.ParseWebsocketLog(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return []*store.WebsocketSession{{Frames: store.WebsocketFramesFromLog(chunks)}}, nil
 }
 
-func (r *ReplayHTTPServer) upgradeConnectionToWebsocket(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error) {
+// upgradeConnectionToWebsocket upgrades the client connection with the
+// subprotocol and headers of the recorded handshake response, if any.
+func (r *ReplayHTTPServer) upgradeConnectionToWebsocket(w http.ResponseWriter, req *http.Request, handshake *store.RecordedResponse) (*websocket.Conn, error) {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -331,8 +411,16 @@ func (r *ReplayHTTPServer) upgradeConnectionToWebsocket(w http.ResponseWriter, r
 			return true // Allow all origins
 		},
 	}
+	var responseHeader http.Header
+	if handshake != nil {
+		var subprotocol string
+		responseHeader, subprotocol = store.UpgradeResponseHeader(handshake.Headers)
+		if subprotocol != "" {
+			upgrader.Subprotocols = []string{subprotocol}
+		}
+	}
 
-	clientConn, err := upgrader.Upgrade(w, req, nil)
+	clientConn, err := upgrader.Upgrade(w, req, responseHeader)
 	if err != nil {
 		return nil, err
 	}
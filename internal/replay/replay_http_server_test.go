@@ -0,0 +1,163 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayHTTPServer_WriteMiss(t *testing.T) {
+	testCases := []struct {
+		name                string
+		onMiss              config.MissConfig
+		expectedStatus      int
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "Default miss response",
+			onMiss:              config.MissConfig{},
+			expectedStatus:      http.StatusInternalServerError,
+			expectedContentType: "text/plain; charset=utf-8",
+			expectedBody:        "Error loading response: not found\n",
+		},
+		{
+			name:                "Text miss response with status code",
+			onMiss:              config.MissConfig{StatusCode: http.StatusNotFound, Message: "no recording"},
+			expectedStatus:      http.StatusNotFound,
+			expectedContentType: "text/plain; charset=utf-8",
+			expectedBody:        "no recording\n",
+		},
+		{
+			name:                "Google miss response",
+			onMiss:              config.MissConfig{StatusCode: http.StatusNotFound, Format: "google"},
+			expectedStatus:      http.StatusNotFound,
+			expectedContentType: "application/json; charset=UTF-8",
+			expectedBody:        `{"error":{"code":404,"message":"Error loading response: not found","status":"NOT_FOUND"}}`,
+		},
+		{
+			name:                "Google miss response with default status code",
+			onMiss:              config.MissConfig{Format: "google"},
+			expectedStatus:      http.StatusInternalServerError,
+			expectedContentType: "application/json; charset=UTF-8",
+			expectedBody:        `{"error":{"code":500,"message":"Error loading response: not found","status":"INTERNAL"}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewReplayHTTPServer(&config.EndpointConfig{OnMiss: tc.onMiss}, t.TempDir(), nil, nil)
+			w := httptest.NewRecorder()
+			server.writeMiss(w, "Error loading response: not found")
+
+			require.Equal(t, tc.expectedStatus, w.Code)
+			require.Equal(t, "true", w.Header().Get(MissHeader))
+			require.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+			require.Equal(t, tc.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestReplayHTTPServer_ReplayWebsocket(t *testing.T) {
+	recordingDir := t.TempDir()
+	handshake := &store.RecordedResponse{
+		StatusCode: http.StatusSwitchingProtocols,
+		Headers: map[string]string{
+			"Upgrade":                "websocket",
+			"Sec-Websocket-Accept":   "recorded",
+			"Sec-Websocket-Protocol": "v2.live",
+			"X-Session-Id":           "session-1",
+		},
+	}
+	recording := &store.WebsocketRecording{RecordID: "websocket-test", Sessions: []*store.WebsocketSession{{Response: handshake, Frames: []*store.WebsocketFrame{
+		store.NewWebsocketFrame(store.DirectionClient, store.OpcodeText, []byte(`{"setup":{}}`), 0),
+		store.NewWebsocketFrame(store.DirectionServer, store.OpcodeText, []byte(`{"setupComplete":{}}`), 0),
+		store.NewWebsocketFrame(store.DirectionServer, store.OpcodeBinary, []byte{0x00, 0x01}, 0),
+		{Direction: store.DirectionServer, Opcode: store.OpcodeClose, CloseCode: websocket.CloseGoingAway, CloseReason: "session expired"},
+	}}}}
+	buf, err := recording.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(recordingDir, "websocket-test.websocket.json"), buf, 0644))
+
+	server := NewReplayHTTPServer(&config.EndpointConfig{}, recordingDir, nil, nil)
+	httpServer := httptest.NewServer(http.HandlerFunc(server.handleRequest))
+	defer httpServer.Close()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+	dialer := websocket.Dialer{Subprotocols: []string{"v1", "v2.live"}}
+	conn, resp, err := dialer.Dial(url, http.Header{"Test-Name": {"websocket-test"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "v2.live", conn.Subprotocol())
+	require.Equal(t, "session-1", resp.Header.Get("X-Session-Id"))
+	require.NotEqual(t, "recorded", resp.Header.Get("Sec-Websocket-Accept"))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"setup":{}}`)))
+	msgType, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.TextMessage, msgType)
+	require.Equal(t, `{"setupComplete":{}}`, string(msg))
+
+	msgType, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, msgType)
+	require.Equal(t, []byte{0x00, 0x01}, msg)
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "expected a close error, got %v", err)
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.Equal(t, "session expired", closeErr.Text)
+}
+
+func TestReplayHTTPServer_NextWebsocketSession(t *testing.T) {
+	handshake := func(url string) *store.RecordedRequest {
+		return &store.RecordedRequest{Method: "GET", URL: url, Headers: map[string]string{"Test-Name": "sessions"}}
+	}
+	first := &store.WebsocketSession{Request: handshake("/ws?model=a"), Frames: []*store.WebsocketFrame{{OffsetMs: 1}}}
+	other := &store.WebsocketSession{Request: handshake("/ws?model=b"), Frames: []*store.WebsocketFrame{{OffsetMs: 2}}}
+	second := &store.WebsocketSession{Request: handshake("/ws?model=a"), Frames: []*store.WebsocketFrame{{OffsetMs: 3}}}
+
+	recordingDir := t.TempDir()
+	buf, err := (&store.WebsocketRecording{RecordID: "sessions", Sessions: []*store.WebsocketSession{first, other, second}}).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(recordingDir, "sessions.websocket.json"), buf, 0644))
+	server := NewReplayHTTPServer(&config.EndpointConfig{}, recordingDir, nil, nil)
+
+	var offsets []int64
+	for _, url := range []string{"/ws?model=a", "/ws?model=b", "/ws?model=a", "/ws?model=a"} {
+		session, err := server.nextWebsocketSession("sessions", handshake(url))
+		require.NoError(t, err)
+		offsets = append(offsets, session.Frames[0].OffsetMs)
+	}
+	require.Equal(t, []int64{1, 2, 3, 1}, offsets)
+
+	_, err = server.nextWebsocketSession("sessions", handshake("/ws?model=c"))
+	require.Error(t, err)
+	_, err = server.nextWebsocketSession("missing", handshake("/ws?model=a"))
+	require.Error(t, err)
+}
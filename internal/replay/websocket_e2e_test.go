@@ -0,0 +1,203 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/listen"
+	"github.com/google/test-server/internal/record"
+	"github.com/google/test-server/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer is a plain ws:// server that answers every message with its
+// payload prefixed with "echo: ", with the same message type.
+func echoServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"echo.v1"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, http.Header{"X-Echo-Session": {"42"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, append([]byte("echo: "), msg...)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runEchoSession opens a websocket to the server, exchanges the test messages
+// and closes the connection.
+func runEchoSession(t *testing.T, serverURL string) {
+	dialer := websocket.Dialer{Subprotocols: []string{"echo.v1"}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/live", http.Header{"Test-Name": {"websocket-e2e"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "echo.v1", conn.Subprotocol())
+	require.Equal(t, "42", resp.Header.Get("X-Echo-Session"))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`)))
+	msgType, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.TextMessage, msgType)
+	require.Equal(t, `echo: {"text":"hello"}`, string(msg))
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte{0x01, 0x02}))
+	msgType, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, msgType)
+	require.Equal(t, []byte("echo: \x01\x02"), msg)
+
+	require.NoError(t, conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"), time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "expected a normal close, got %v", err)
+}
+
+func TestWebsocket_RecordAndReplay(t *testing.T) {
+	upstream := echoServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+	}
+	recordingDir := t.TempDir()
+
+	proxy := httptest.NewServer(listen.Handler(record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)))
+	defer proxy.Close()
+	runEchoSession(t, proxy.URL)
+
+	recordingPath := filepath.Join(recordingDir, "websocket-e2e.websocket.json")
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(recordingPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "the recording should be written once the connection is closed")
+	buf, err := os.ReadFile(recordingPath)
+	require.NoError(t, err)
+	recording, err := store.ParseWebsocketRecording(buf)
+	require.NoError(t, err)
+	require.Len(t, recording.Sessions, 1)
+	session := recording.Sessions[0]
+	require.Equal(t, "echo.v1", session.Response.Headers["Sec-Websocket-Protocol"])
+	var opcodes []string
+	for _, frame := range session.Frames {
+		opcodes = append(opcodes, frame.Direction+" "+frame.Opcode)
+	}
+	require.Equal(t, []string{"client text", "server text", "client binary", "server binary", "client close", "server close"}, opcodes)
+
+	// Replay without the upstream server.
+	upstream.Close()
+	replay := httptest.NewServer(listen.Handler(NewReplayHTTPServer(cfg, recordingDir, nil, nil)))
+	defer replay.Close()
+	runEchoSession(t, replay.URL)
+}
+
+// droppingServer is a plain ws:// server that answers the first message, then
+// drops the connection without a close frame.
+func droppingServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.NetConn().Close()
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(msgType, msg)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runDroppedSession opens a websocket to the server, exchanges a message and
+// checks that the connection is then dropped without a close frame.
+func runDroppedSession(t *testing.T, serverURL string) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/live", http.Header{"Test-Name": {"websocket-dropped"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"text":"hello"}`)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, `{"text":"hello"}`, string(msg))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseAbnormalClosure), "expected a dropped connection, got %v", err)
+}
+
+func TestWebsocket_DroppedConnection(t *testing.T) {
+	upstream := droppingServer(t)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		TargetType: "http",
+		TargetHost: upstreamURL.Hostname(),
+		TargetPort: port,
+	}
+	recordingDir := t.TempDir()
+
+	proxy := httptest.NewServer(listen.Handler(record.NewRecordingHTTPSProxy(cfg, recordingDir, nil, nil)))
+	defer proxy.Close()
+	runDroppedSession(t, proxy.URL)
+
+	recordingPath := filepath.Join(recordingDir, "websocket-dropped.websocket.json")
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(recordingPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "the recording should be written once the connection is closed")
+	buf, err := os.ReadFile(recordingPath)
+	require.NoError(t, err)
+	recording, err := store.ParseWebsocketRecording(buf)
+	require.NoError(t, err)
+	require.Len(t, recording.Sessions, 1)
+	frames := recording.Sessions[0].Frames
+	last := frames[len(frames)-1]
+	require.Equal(t, store.DirectionServer, last.Direction)
+	require.Equal(t, store.OpcodeClose, last.Opcode)
+	require.Equal(t, websocket.CloseAbnormalClosure, last.CloseCode)
+
+	// Replay drops the connection too, instead of sending the reserved code.
+	upstream.Close()
+	replay := httptest.NewServer(listen.Handler(NewReplayHTTPServer(cfg, recordingDir, nil, nil)))
+	defer replay.Close()
+	runDroppedSession(t, replay.URL)
+}
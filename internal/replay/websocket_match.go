@@ -0,0 +1,135 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/test-server/internal/jsonpath"
+)
+
+// diffJSONMessage compares a client message, of a websocket or a gRPC call,
+// to the recorded one, and returns their differences. Messages that are both
+// JSON are compared semantically, without the values addressed by the ignored
+// paths, which may also be absent on either side. Other messages must be
+// identical.
+func diffJSONMessage(recorded []byte, received []byte, ignore []jsonpath.Path) []string {
+	var recordedDoc, receivedDoc any
+	if json.Unmarshal(recorded, &recordedDoc) != nil || json.Unmarshal(received, &receivedDoc) != nil {
+		if bytes.Equal(recorded, received) {
+			return nil
+		}
+		return []string{fmt.Sprintf("recorded %q, got %q", recorded, received)}
+	}
+	for _, path := range ignore {
+		path.Delete(recordedDoc)
+		path.Delete(receivedDoc)
+	}
+	return diffJSON("", recordedDoc, receivedDoc)
+}
+
+func diffJSON(path string, recorded any, received any) []string {
+	switch recordedValue := recorded.(type) {
+	case map[string]any:
+		receivedValue, ok := received.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(recordedValue)+len(receivedValue))
+		for key := range recordedValue {
+			keys = append(keys, key)
+		}
+		for key := range receivedValue {
+			if _, ok := recordedValue[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			recordedItem, inRecorded := recordedValue[key]
+			receivedItem, inReceived := receivedValue[key]
+			switch {
+			case !inReceived:
+				diffs = append(diffs, fmt.Sprintf("%s: missing, recorded %s", keyPath, formatJSON(recordedItem)))
+			case !inRecorded:
+				diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", keyPath, formatJSON(receivedItem)))
+			default:
+				diffs = append(diffs, diffJSON(keyPath, recordedItem, receivedItem)...)
+			}
+		}
+		return diffs
+	case []any:
+		receivedValue, ok := received.([]any)
+		if !ok {
+			break
+		}
+		if len(recordedValue) != len(receivedValue) {
+			return []string{fmt.Sprintf("%s: recorded %d elements, got %d", displayPath(path), len(recordedValue), len(receivedValue))}
+		}
+		var diffs []string
+		for i := range recordedValue {
+			diffs = append(diffs, diffJSON(fmt.Sprintf("%s[%d]", path, i), recordedValue[i], receivedValue[i])...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(recorded, received) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: recorded %s, got %s", displayPath(path), formatJSON(recorded), formatJSON(received))}
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "$"
+	}
+	return path
+}
+
+func formatJSON(value any) string {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(buf)
+}
+
+// closeReason returns the reason of the close frame sent on a mismatch, which
+// must fit in a control frame.
+func closeReason(diffs []string) string {
+	const maxLength = 123 // 125 bytes of payload minus the close code
+	reason := "input chunk mismatch: " + strings.Join(diffs, "; ")
+	if len(reason) <= maxLength {
+		return reason
+	}
+	reason = reason[:maxLength-3]
+	// Do not cut a UTF-8 sequence in half.
+	for len(reason) > 0 && !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason + "..."
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffJSONMessage(t *testing.T) {
+	testCases := []struct {
+		name          string
+		recorded      string
+		received      string
+		ignorePaths   []string
+		expectedDiffs []string
+	}{
+		{
+			name:     "Reordered keys",
+			recorded: `{"a":1,"b":{"c":[1,2]}}`,
+			received: `{"b":{"c":[1,2]},"a":1.0}`,
+		},
+		{
+			name:          "Different values",
+			recorded:      `{"setup":{"model":"a","tools":[{"name":"x"}]}}`,
+			received:      `{"setup":{"model":"b","tools":[{"name":"y"}]}}`,
+			expectedDiffs: []string{`setup.model: recorded "a", got "b"`, `setup.tools[0].name: recorded "x", got "y"`},
+		},
+		{
+			name:          "Missing and unexpected keys",
+			recorded:      `{"a":1,"b":2}`,
+			received:      `{"b":2,"c":3}`,
+			expectedDiffs: []string{`a: missing, recorded 1`, `c: unexpected 3`},
+		},
+		{
+			name:          "Different array lengths",
+			recorded:      `{"a":[1,2]}`,
+			received:      `{"a":[1]}`,
+			expectedDiffs: []string{`a: recorded 2 elements, got 1`},
+		},
+		{
+			name:          "Different types",
+			recorded:      `{"a":{"b":1}}`,
+			received:      `{"a":[1]}`,
+			expectedDiffs: []string{`a: recorded {"b":1}, got [1]`},
+		},
+		{
+			name:        "Ignored paths",
+			recorded:    `{"clientContent":{"turns":[{"timestamp":1}]},"id":"a"}`,
+			received:    `{"clientContent":{"turns":[{"timestamp":2}]},"id":"b"}`,
+			ignorePaths: []string{"clientContent.turns[*].timestamp", "id"},
+		},
+		{
+			name:        "Ignored paths absent on one side",
+			recorded:    `{"clientContent":{"turns":[{"text":"hi","timestamp":1}]},"id":"a"}`,
+			received:    `{"clientContent":{"turns":[{"text":"hi"}]}}`,
+			ignorePaths: []string{"clientContent.turns[*].timestamp", "id"},
+		},
+		{
+			name:          "Ignored array elements",
+			recorded:      `{"a":[1,2,3]}`,
+			received:      `{"a":[4,2,5]}`,
+			ignorePaths:   []string{"a[0]"},
+			expectedDiffs: []string{`a[2]: recorded 3, got 5`},
+		},
+		{
+			name:     "Identical text",
+			recorded: "hello",
+			received: "hello",
+		},
+		{
+			name:          "Different text",
+			recorded:      "hello",
+			received:      "bye",
+			expectedDiffs: []string{`recorded "hello", got "bye"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			paths, err := jsonpath.ParseAll(tc.ignorePaths)
+			require.NoError(t, err)
+			diffs := diffJSONMessage([]byte(tc.recorded), []byte(tc.received), paths)
+			require.Equal(t, tc.expectedDiffs, diffs)
+		})
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	require.Equal(t, `input chunk mismatch: a: recorded 1, got 2`, closeReason([]string{"a: recorded 1, got 2"}))
+
+	reason := closeReason([]string{"x" + strings.Repeat("é", 100)})
+	require.Len(t, reason, 122, "the reason should be cut before a split character")
+	require.True(t, utf8.ValidString(reason))
+	require.True(t, strings.HasSuffix(reason, "..."))
+}
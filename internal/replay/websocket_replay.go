@@ -0,0 +1,257 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/store"
+	"github.com/google/test-server/internal/wsconn"
+	"github.com/gorilla/websocket"
+)
+
+// closeTimeout is how long replay waits for the client to answer a close frame.
+const closeTimeout = time.Second
+
+// websocketReplay replays a recorded session on a client connection. The
+// server frames are sent while the client frames are read and validated, so
+// that the server can push messages independently of the client. A server
+// frame is only sent once the client frames recorded before it were received,
+// and with timing enabled, no earlier than it was recorded.
+type websocketReplay struct {
+	server      *ReplayHTTPServer
+	conn        *websocket.Conn
+	frames      []*store.WebsocketFrame
+	ignorePaths []jsonpath.Path
+	timing      bool
+	watchdog    *wsconn.IdleWatchdog
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// received has a channel per client frame, closed once the frame was
+	// received and validated.
+	received []chan struct{}
+	// closeSent is set when the server close frame was sent, or the connection
+	// was dropped as recorded.
+	closeSent atomic.Bool
+}
+
+func (r *ReplayHTTPServer) replayWebsocket(conn *websocket.Conn, frames []*store.WebsocketFrame) {
+	// Recorded pings and pongs are not replayed, replay answers pings itself.
+	var dataFrames []*store.WebsocketFrame
+	for _, frame := range frames {
+		if frame.Opcode != store.OpcodePing && frame.Opcode != store.OpcodePong {
+			dataFrames = append(dataFrames, frame)
+		}
+	}
+	watchdog := wsconn.NewIdleWatchdog(r.config.WebsocketIdleTimeout, conn)
+	defer watchdog.Stop()
+	conn.SetPingHandler(func(data string) error {
+		watchdog.Touch()
+		if err := wsconn.WriteControl(conn, websocket.PongMessage, data); err != nil {
+			fmt.Printf("Error answering websocket ping: %v\n", err)
+		}
+		return nil
+	})
+	conn.SetPongHandler(func(string) error {
+		watchdog.Touch()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replay := &websocketReplay{
+		server:      r,
+		conn:        conn,
+		frames:      dataFrames,
+		watchdog:    watchdog,
+		ignorePaths: r.config.WebsocketIgnorePaths,
+		timing:      r.config.WebsocketReplayTiming,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	replay.run()
+}
+
+func (w *websocketReplay) run() {
+	for _, frame := range w.frames {
+		if frame.Direction == store.DirectionClient {
+			w.received = append(w.received, make(chan struct{}))
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.readClientFrames()
+	}()
+	go func() {
+		defer wg.Done()
+		w.writeServerFrames()
+	}()
+	wg.Wait()
+
+	if w.closeSent.Load() {
+		// Wait for the client to answer the close frame, the reader is done so
+		// that there is a single reader.
+		w.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for {
+			if _, _, err := w.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// abort stops the replay and unblocks the reader.
+func (w *websocketReplay) abort() {
+	w.cancel()
+	w.conn.Close()
+}
+
+// readClientFrames reads and validates the client frames in the recorded order.
+func (w *websocketReplay) readClientFrames() {
+	i := 0
+	for _, frame := range w.frames {
+		if frame.Direction == store.DirectionServer {
+			continue
+		}
+		if frame.Direction != store.DirectionClient {
+			fmt.Printf("Unrecognized frame direction: %s\n", frame.Direction)
+			w.abort()
+			return
+		}
+		_, buf, err := w.conn.ReadMessage()
+		w.watchdog.Touch()
+		if frame.Opcode == store.OpcodeClose {
+			// The default close handler answers the close of the client.
+			if _, ok := err.(*websocket.CloseError); !ok {
+				fmt.Printf("Expected the client to close the websocket, got: %v\n", err)
+			}
+			w.cancel()
+			return
+		}
+		if err != nil {
+			if w.ctx.Err() == nil && !w.closeSent.Load() {
+				fmt.Printf("Error reading from websocket: %v\n", err)
+			}
+			w.abort()
+			return
+		}
+
+		recorded, err := frame.Data()
+		if err != nil {
+			fmt.Printf("Error loading websocket frame: %v\n", err)
+			w.abort()
+			return
+		}
+		reqChunk := w.server.redactor.String(string(buf))
+		if diffs := diffJSONMessage(recorded, []byte(reqChunk), w.ignorePaths); len(diffs) > 0 {
+			fmt.Printf("input chunk mismatch\n Input chunk: %s\n Recorded chunk: %s\n Differences:\n  %s\n", reqChunk, string(recorded), strings.Join(diffs, "\n  "))
+			writeError(w.conn, closeReason(diffs))
+			w.cancel()
+			return
+		}
+		close(w.received[i])
+		i++
+	}
+}
+
+// writeServerFrames sends the server frames in the recorded order, each once
+// the client frames recorded before it were received.
+func (w *websocketReplay) writeServerFrames() {
+	start := time.Now()
+	clientFrames := 0
+	for _, frame := range w.frames {
+		if frame.Direction == store.DirectionClient {
+			clientFrames++
+			continue
+		}
+		if frame.Direction != store.DirectionServer {
+			return
+		}
+		if clientFrames > 0 {
+			select {
+			case <-w.received[clientFrames-1]:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		if w.timing {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(frame.OffsetMs) * time.Millisecond))):
+			case <-w.ctx.Done():
+				return
+			}
+		}
+
+		if frame.Opcode == store.OpcodeClose {
+			if wsconn.IsReservedCloseCode(frame.CloseCode) {
+				// The recorded connection ended without a close status, such
+				// as when it dropped, so the connection is dropped too.
+				w.closeSent.Store(true)
+				w.abort()
+				return
+			}
+			if err := wsconn.Close(w.conn, frame.CloseCode, frame.CloseReason); err != nil {
+				fmt.Printf("Failed to write close: %v\n", err)
+				w.abort()
+				return
+			}
+			w.closeSent.Store(true)
+			return
+		}
+		recorded, err := frame.Data()
+		if err != nil {
+			fmt.Printf("Error loading websocket frame: %v\n", err)
+			w.abort()
+			return
+		}
+		if err := w.conn.WriteMessage(messageType(frame.Opcode), recorded); err != nil {
+			if w.ctx.Err() == nil {
+				fmt.Printf("Error writing to websocket: %v\n", err)
+			}
+			w.abort()
+			return
+		}
+		w.watchdog.Touch()
+	}
+}
+
+// messageType returns the websocket message type of a recorded opcode.
+func messageType(opcode string) int {
+	if opcode == store.OpcodeText {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// writeError closes the connection with an internal error. It can be called
+// concurrently with the writes of the server frames.
+func writeError(conn *websocket.Conn, errMsg string) {
+	err := wsconn.Close(conn, websocket.CloseInternalServerErr, errMsg)
+	if err != nil {
+		fmt.Printf("Failed to write error: %v\n", err)
+	}
+}
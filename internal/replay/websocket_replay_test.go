@@ -0,0 +1,120 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/store"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// dialReplay starts a server replaying the given frames, and connects to it.
+func dialReplay(t *testing.T, cfg *config.EndpointConfig, frames []*store.WebsocketFrame) *websocket.Conn {
+	server := NewReplayHTTPServer(cfg, t.TempDir(), nil, nil)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		server.proxyWebsocket(w, req, &store.WebsocketSession{Frames: frames})
+	}))
+	t.Cleanup(httpServer.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func textFrame(direction string, payload string, offsetMs int64) *store.WebsocketFrame {
+	return store.NewWebsocketFrame(direction, store.OpcodeText, []byte(payload), time.Duration(offsetMs)*time.Millisecond)
+}
+
+func TestReplayWebsocket_Timing(t *testing.T) {
+	conn := dialReplay(t, &config.EndpointConfig{WebsocketReplayTiming: true}, []*store.WebsocketFrame{
+		textFrame(store.DirectionServer, "first", 0),
+		textFrame(store.DirectionClient, "request", 10),
+		textFrame(store.DirectionServer, "second", 150),
+	})
+	start := time.Now()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("request")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "first", string(msg))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "second", string(msg))
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestReplayWebsocket_WaitsForPrecedingClientFrames(t *testing.T) {
+	conn := dialReplay(t, &config.EndpointConfig{}, []*store.WebsocketFrame{
+		textFrame(store.DirectionClient, "first", 0),
+		textFrame(store.DirectionClient, "second", 0),
+		textFrame(store.DirectionServer, "response", 0),
+	})
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("first")))
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := conn.ReadMessage()
+	require.Error(t, err, "the response should wait for the second client frame")
+}
+
+func TestReplayWebsocket_MismatchWhileStreaming(t *testing.T) {
+	conn := dialReplay(t, &config.EndpointConfig{WebsocketReplayTiming: true}, []*store.WebsocketFrame{
+		textFrame(store.DirectionServer, "chunk-1", 0),
+		textFrame(store.DirectionServer, "chunk-2", 5000),
+		textFrame(store.DirectionClient, `{"turn":1}`, 10),
+	})
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"turn":2}`)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "chunk-1", string(msg))
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "expected a close error, got %v", err)
+	require.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	require.Equal(t, "input chunk mismatch: turn: recorded 1, got 2", closeErr.Text)
+}
+
+func TestReplayWebsocket_PingAndIdleTimeout(t *testing.T) {
+	conn := dialReplay(t, &config.EndpointConfig{WebsocketIdleTimeout: 200 * time.Millisecond}, []*store.WebsocketFrame{
+		{Direction: store.DirectionClient, Opcode: store.OpcodePing},
+		textFrame(store.DirectionClient, "never sent", 0),
+	})
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	require.NoError(t, conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(time.Second)))
+
+	start := time.Now()
+	_, _, err := conn.ReadMessage()
+	require.Equal(t, "keepalive", <-pongs)
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "expected a close error, got %v", err)
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.Equal(t, "idle timeout", closeErr.Text)
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatJUnit = "junit"
+)
+
+// Report collects per test bookkeeping of the interactions served or recorded
+// by test-server. A nil *Report is valid and ignores all updates.
+type Report struct {
+	mu    sync.Mutex
+	mode  string
+	tests map[string]*testState
+}
+
+type testState struct {
+	hits           int
+	misses         int
+	recorded       int
+	files          map[string]struct{}
+	known          map[string]struct{}
+	used           map[string]struct{}
+	missedRequests []string
+}
+
+// TestReport is the summary of a single test, identified by its recording name.
+type TestReport struct {
+	Name           string   `json:"name"`
+	Hits           int      `json:"hits"`
+	Misses         int      `json:"misses"`
+	Unused         int      `json:"unused"`
+	Recorded       int      `json:"recorded"`
+	Files          []string `json:"files,omitempty"`
+	MissedRequests []string `json:"missedRequests,omitempty"`
+}
+
+// Totals aggregates the counters of all tests in a report.
+type Totals struct {
+	Hits     int `json:"hits"`
+	Misses   int `json:"misses"`
+	Unused   int `json:"unused"`
+	Recorded int `json:"recorded"`
+}
+
+// Summary is the serializable form of a Report.
+type Summary struct {
+	Mode   string       `json:"mode"`
+	Tests  []TestReport `json:"tests"`
+	Totals Totals       `json:"totals"`
+}
+
+// New creates an empty report for the given mode, either "record" or "replay".
+func New(mode string) *Report {
+	return &Report{
+		mode:  mode,
+		tests: make(map[string]*testState),
+	}
+}
+
+func (r *Report) test(name string) *testState {
+	t, ok := r.tests[name]
+	if !ok {
+		t = &testState{
+			files: make(map[string]struct{}),
+			known: make(map[string]struct{}),
+			used:  make(map[string]struct{}),
+		}
+		r.tests[name] = t
+	}
+	return t
+}
+
+// Loaded records that the recording file at path was read for the given test,
+// and that it contains interactions with the given sha sums.
+func (r *Report) Loaded(testName string, path string, shaSums []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(testName)
+	t.files[path] = struct{}{}
+	for _, shaSum := range shaSums {
+		t.known[shaSum] = struct{}{}
+	}
+}
+
+// Hit records that a request of the given test was answered from a recording.
+func (r *Report) Hit(testName string, shaSum string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(testName)
+	t.hits++
+	if shaSum != "" {
+		t.used[shaSum] = struct{}{}
+	}
+}
+
+// Miss records that a request of the given test had no recorded response.
+func (r *Report) Miss(testName string, request string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(testName)
+	t.misses++
+	t.missedRequests = append(t.missedRequests, request)
+}
+
+// Recorded records that an interaction of the given test was written to path.
+func (r *Report) Recorded(testName string, path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.test(testName)
+	t.recorded++
+	t.files[path] = struct{}{}
+}
+
+// Summary returns a snapshot of the report, with tests sorted by name.
+func (r *Report) Summary() Summary {
+	summary := Summary{Tests: []TestReport{}}
+	if r == nil {
+		return summary
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	summary.Mode = r.mode
+	for name, t := range r.tests {
+		tr := TestReport{
+			Name:           name,
+			Hits:           t.hits,
+			Misses:         t.misses,
+			Recorded:       t.recorded,
+			MissedRequests: t.missedRequests,
+		}
+		for shaSum := range t.known {
+			if _, ok := t.used[shaSum]; !ok {
+				tr.Unused++
+			}
+		}
+		for file := range t.files {
+			tr.Files = append(tr.Files, file)
+		}
+		sort.Strings(tr.Files)
+		summary.Tests = append(summary.Tests, tr)
+
+		summary.Totals.Hits += tr.Hits
+		summary.Totals.Misses += tr.Misses
+		summary.Totals.Unused += tr.Unused
+		summary.Totals.Recorded += tr.Recorded
+	}
+	sort.Slice(summary.Tests, func(i, j int) bool {
+		return summary.Tests[i].Name < summary.Tests[j].Name
+	})
+	return summary
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	buf, err := json.MarshalIndent(r.Summary(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML, with one test case per test.
+// Tests with replay misses are reported as failures.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	summary := r.Summary()
+	suite := junitTestSuite{
+		Name:  "test-server " + summary.Mode,
+		Tests: len(summary.Tests),
+		Properties: []junitProperty{
+			{Name: "hits", Value: fmt.Sprint(summary.Totals.Hits)},
+			{Name: "misses", Value: fmt.Sprint(summary.Totals.Misses)},
+			{Name: "unused", Value: fmt.Sprint(summary.Totals.Unused)},
+			{Name: "recorded", Value: fmt.Sprint(summary.Totals.Recorded)},
+		},
+	}
+	for _, t := range summary.Tests {
+		var out strings.Builder
+		fmt.Fprintf(&out, "hits: %d\nmisses: %d\nunused: %d\nrecorded: %d\n", t.Hits, t.Misses, t.Unused, t.Recorded)
+		for _, file := range t.Files {
+			fmt.Fprintf(&out, "file: %s\n", file)
+		}
+		testCase := junitTestCase{
+			ClassName: "test-server." + summary.Mode,
+			Name:      t.Name,
+			SystemOut: out.String(),
+		}
+		if t.Misses > 0 {
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d request(s) had no recorded response", t.Misses),
+				Type:    "ReplayMiss",
+				Content: strings.Join(t.MissedRequests, "\n"),
+			}
+			suite.Failures++
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	suites := junitTestSuites{
+		Name:     "test-server",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Suites:   []junitTestSuite{suite},
+	}
+	buf, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// ValidateFormat returns an error when format is not a supported report format.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatJUnit:
+		return nil
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// WriteFile writes the report to path in the given format.
+func (r *Report) WriteFile(path string, format string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if format == FormatJUnit {
+		err = r.WriteJUnit(file)
+	} else {
+		err = r.WriteJSON(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write report file %s: %w", path, err)
+	}
+	return nil
+}
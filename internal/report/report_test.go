@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReplayReport() *Report {
+	r := New("replay")
+	r.Loaded("test_a", "recordings/test_a.json", []string{"sha1", "sha2", "sha3"})
+	r.Hit("test_a", "sha1")
+	r.Hit("test_a", "sha2")
+	r.Miss("test_b", "GET /v1/models HTTP/1.1")
+	return r
+}
+
+func TestReport_Summary(t *testing.T) {
+	testCases := []struct {
+		name     string
+		report   *Report
+		expected Summary
+	}{
+		{
+			name:   "Nil report",
+			report: nil,
+			expected: Summary{
+				Tests: []TestReport{},
+			},
+		},
+		{
+			name:   "Replay report",
+			report: newReplayReport(),
+			expected: Summary{
+				Mode: "replay",
+				Tests: []TestReport{
+					{
+						Name:   "test_a",
+						Hits:   2,
+						Unused: 1,
+						Files:  []string{"recordings/test_a.json"},
+					},
+					{
+						Name:           "test_b",
+						Misses:         1,
+						MissedRequests: []string{"GET /v1/models HTTP/1.1"},
+					},
+				},
+				Totals: Totals{Hits: 2, Misses: 1, Unused: 1},
+			},
+		},
+		{
+			name: "Record report",
+			report: func() *Report {
+				r := New("record")
+				r.Recorded("test_a", "recordings/test_a.json")
+				r.Recorded("test_a", "recordings/test_a.json")
+				return r
+			}(),
+			expected: Summary{
+				Mode: "record",
+				Tests: []TestReport{
+					{
+						Name:     "test_a",
+						Recorded: 2,
+						Files:    []string{"recordings/test_a.json"},
+					},
+				},
+				Totals: Totals{Recorded: 2},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.report.Summary())
+		})
+	}
+}
+
+func TestReport_WriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, newReplayReport().WriteJSON(&buf))
+
+	var summary Summary
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &summary))
+	require.Equal(t, newReplayReport().Summary(), summary)
+}
+
+func TestReport_WriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, newReplayReport().WriteJUnit(&buf))
+
+	out := buf.String()
+	require.True(t, strings.HasPrefix(out, "<?xml"))
+	require.Contains(t, out, `<testsuites name="test-server" tests="2" failures="1">`)
+	require.Contains(t, out, `<testcase classname="test-server.replay" name="test_a">`)
+	require.Contains(t, out, `<failure message="1 request(s) had no recorded response" type="ReplayMiss">GET /v1/models HTTP/1.1</failure>`)
+}
+
+func TestValidateFormat(t *testing.T) {
+	require.NoError(t, ValidateFormat(FormatJSON))
+	require.NoError(t, ValidateFormat(FormatJUnit))
+	require.Error(t, ValidateFormat("yaml"))
+}
@@ -0,0 +1,470 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rewrite applies the current redaction config to existing recordings.
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
+)
+
+// Summary describes the changes made to a recording directory.
+type Summary struct {
+	// Files are the paths of the files that were scanned.
+	Files []string
+	// Changed are the paths of the files whose content changed.
+	Changed []string
+	// Renamed maps the old to the new paths of recordings named after the
+	// sha sum of their request.
+	Renamed map[string]string
+	// Interactions is the number of interactions whose sha sum changed.
+	Interactions int
+}
+
+type recording struct {
+	path     string
+	original []byte
+	file     *store.RecordFile
+	// namePrevious is the previous request the recording was named with, for
+	// recordings named after the sha sum of their request.
+	namePrevious string
+	// renamable is set for recordings named after the sha sum of their
+	// request.
+	renamable bool
+}
+
+type grpcRecording struct {
+	path      string
+	original  []byte
+	recording *store.GRPCRecording
+	// newPath is the path of the recording once redacted, which changes for
+	// recordings named after the sha sum of their request.
+	newPath string
+}
+
+// Rewrite redacts the recordings in recordingDir in place with the current
+// config, and recomputes the sha sums and previous request links so that the
+// recordings keep matching in replay. With dryRun set, the summary of the
+// changes is computed but no file is written.
+func Rewrite(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact, dryRun bool) (*Summary, error) {
+	summary := &Summary{Renamed: make(map[string]string)}
+	var recordings []*recording
+	var websocketLogs []string
+	var websocketRecordings []string
+	var grpcRecordings []*grpcRecording
+
+	err := filepath.WalkDir(recordingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".websocket.log"):
+			websocketLogs = append(websocketLogs, path)
+		case strings.HasSuffix(path, ".websocket.json"):
+			websocketRecordings = append(websocketRecordings, path)
+		case strings.HasSuffix(path, ".grpc.json"):
+			rec, err := loadGRPCRecording(path)
+			if err != nil {
+				return err
+			}
+			grpcRecordings = append(grpcRecordings, rec)
+		case strings.HasSuffix(path, ".json"):
+			rec, err := loadRecording(path)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				recordings = append(recordings, rec)
+			}
+		default:
+			return nil
+		}
+		summary.Files = append(summary.Files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	findNamePrevious(recordings)
+	for _, rec := range recordings {
+		if err := redactRecording(cfg, rec, redactor); err != nil {
+			return nil, fmt.Errorf("failed redacting %s: %w", rec.path, err)
+		}
+	}
+	var newSums map[string]string
+	summary.Interactions, newSums = relink(recordings)
+
+	newPaths := make(map[*recording]string, len(recordings))
+	for _, rec := range recordings {
+		newPath := renamedPath(rec, newSums)
+		newPaths[rec] = newPath
+		if newPath != rec.path {
+			summary.Renamed[rec.path] = newPath
+		}
+	}
+	for _, rec := range grpcRecordings {
+		if err := redactGRPCRecording(cfg, rec, redactor); err != nil {
+			return nil, fmt.Errorf("failed redacting %s: %w", rec.path, err)
+		}
+		if rec.newPath != rec.path {
+			summary.Renamed[rec.path] = rec.newPath
+		}
+	}
+	if err := checkRenames(summary.Renamed); err != nil {
+		return nil, err
+	}
+
+	for _, rec := range recordings {
+		newPath := newPaths[rec]
+		buf, err := json.MarshalIndent(rec.file, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(buf, rec.original) && newPath == rec.path {
+			continue
+		}
+		summary.Changed = append(summary.Changed, rec.path)
+		if dryRun {
+			continue
+		}
+		if err := writeRenamed(rec.path, newPath, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range websocketLogs {
+		changed, err := rewriteWebsocketLog(path, redactor, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			summary.Changed = append(summary.Changed, path)
+		}
+	}
+	for _, path := range websocketRecordings {
+		changed, err := rewriteWebsocketRecording(cfg, path, redactor, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			summary.Changed = append(summary.Changed, path)
+		}
+	}
+	for _, rec := range grpcRecordings {
+		buf, err := rec.recording.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(buf, rec.original) && rec.newPath == rec.path {
+			continue
+		}
+		summary.Changed = append(summary.Changed, rec.path)
+		if dryRun {
+			continue
+		}
+		if err := writeRenamed(rec.path, rec.newPath, buf); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(summary.Changed)
+	return summary, nil
+}
+
+// loadRecording loads a recording file, or returns nil when the JSON file
+// is not a recording.
+func loadRecording(path string) (*recording, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var recordFile store.RecordFile
+	if err := json.Unmarshal(buf, &recordFile); err != nil || len(recordFile.Interactions) == 0 {
+		return nil, nil
+	}
+	return &recording{path: path, original: buf, file: &recordFile}, nil
+}
+
+func redactRecording(cfg *config.TestServerConfig, rec *recording, redactor *redact.Redact) error {
+	for _, interaction := range rec.file.Interactions {
+		if interaction.Request == nil {
+			continue
+		}
+		endpoint := cfg.FindEndpoint(interaction.Request.ServerAddress, interaction.Request.Port)
+		if endpoint == nil {
+			endpoint = &config.EndpointConfig{}
+		}
+		if err := interaction.Request.Redact(endpoint, redactor); err != nil {
+			return err
+		}
+		if interaction.Response != nil {
+			if err := interaction.Response.Redact(endpoint, redactor); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findNamePrevious finds the previous request each recording named after the
+// sha sum of its request was named with. Record mode names these recordings
+// after the sum of the request chained to the previous request, then records
+// the request with store.HeadSHA as previous request, so the previous request
+// is found among the recorded sha sums.
+func findNamePrevious(recordings []*recording) {
+	candidates := []string{store.HeadSHA}
+	for _, rec := range recordings {
+		for _, interaction := range rec.file.Interactions {
+			candidates = append(candidates, interaction.SHASum)
+		}
+	}
+	for _, rec := range recordings {
+		request := rec.file.Interactions[0].Request
+		name := strings.TrimSuffix(filepath.Base(rec.path), ".json")
+		if request == nil || request.Headers["Test-Name"] != "" || rec.file.RecordID != name {
+			continue
+		}
+		for _, previous := range append([]string{request.PreviousRequest}, candidates...) {
+			named := *request
+			named.PreviousRequest = previous
+			if named.ComputeSum() == name {
+				rec.namePrevious = previous
+				rec.renamable = true
+				break
+			}
+		}
+	}
+}
+
+// relink recomputes the sha sum of every interaction, following the chains
+// of previous requests from store.HeadSHA. It returns the number of
+// interactions whose sha sum changed, and the new sha sums by old sha sum.
+func relink(recordings []*recording) (int, map[string]string) {
+	var pending []*store.RecordInteraction
+	for _, rec := range recordings {
+		for _, interaction := range rec.file.Interactions {
+			if interaction.Request != nil {
+				pending = append(pending, interaction)
+			}
+		}
+	}
+
+	changed := 0
+	update := func(interaction *store.RecordInteraction) {
+		shaSum := interaction.Request.ComputeSum()
+		if shaSum != interaction.SHASum {
+			changed++
+		}
+		interaction.SHASum = shaSum
+	}
+
+	newSums := map[string]string{store.HeadSHA: store.HeadSHA}
+	for len(pending) > 0 {
+		var remaining []*store.RecordInteraction
+		for _, interaction := range pending {
+			previous, ok := newSums[interaction.Request.PreviousRequest]
+			if !ok {
+				remaining = append(remaining, interaction)
+				continue
+			}
+			interaction.Request.PreviousRequest = previous
+			oldSum := interaction.SHASum
+			update(interaction)
+			newSums[oldSum] = interaction.SHASum
+		}
+		if len(remaining) == len(pending) {
+			// The previous requests of the remaining interactions are not
+			// recorded, keep the links as they are.
+			for _, interaction := range remaining {
+				update(interaction)
+			}
+			break
+		}
+		pending = remaining
+	}
+	return changed, newSums
+}
+
+// renamedPath returns the path of a recording named after the sha sum of its
+// request, which changes when the request is redacted. newSums maps the old
+// to the new sha sums of the requests.
+func renamedPath(rec *recording, newSums map[string]string) string {
+	if !rec.renamable {
+		return rec.path
+	}
+	named := *rec.file.Interactions[0].Request
+	named.PreviousRequest = rec.namePrevious
+	if previous, ok := newSums[rec.namePrevious]; ok {
+		named.PreviousRequest = previous
+	}
+	newName := named.ComputeSum()
+	rec.file.RecordID = newName
+	return filepath.Join(filepath.Dir(rec.path), newName+".json")
+}
+
+// writeRenamed writes buf to path, then renames it to newPath.
+func writeRenamed(path string, newPath string, buf []byte) error {
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		return err
+	}
+	if newPath == path {
+		return nil
+	}
+	return os.Rename(path, newPath)
+}
+
+// checkRenames fails when a renamed recording would replace an existing file
+// or another renamed recording.
+func checkRenames(renamed map[string]string) error {
+	sources := make(map[string]string, len(renamed))
+	for oldPath, newPath := range renamed {
+		if other, ok := sources[newPath]; ok {
+			return fmt.Errorf("cannot rename both %s and %s to %s", other, oldPath, newPath)
+		}
+		sources[newPath] = oldPath
+		if _, err := os.Stat(newPath); err == nil {
+			return fmt.Errorf("cannot rename %s to %s: the file already exists", oldPath, newPath)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func rewriteWebsocketLog(path string, redactor *redact.Redact, dryRun bool) (bool, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	chunks, err := store.ParseWebsocketLog(buf)
+	if err != nil {
+		return false, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	for i, chunk := range chunks {
+		chunks[i] = chunk[:1] + redactor.String(chunk[1:])
+	}
+	redacted := store.FormatWebsocketLog(chunks)
+	if bytes.Equal(buf, redacted) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	return true, os.WriteFile(path, redacted, 0644)
+}
+
+func rewriteWebsocketRecording(cfg *config.TestServerConfig, path string, redactor *redact.Redact, dryRun bool) (bool, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	recording, err := store.ParseWebsocketRecording(buf)
+	if err != nil {
+		return false, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	for _, session := range recording.Sessions {
+		if session.Request != nil {
+			endpoint := cfg.FindEndpoint(session.Request.ServerAddress, session.Request.Port)
+			if endpoint == nil {
+				endpoint = &config.EndpointConfig{}
+			}
+			if err := session.Request.Redact(endpoint, redactor); err != nil {
+				return false, fmt.Errorf("failed redacting %s: %w", path, err)
+			}
+			if session.Response != nil {
+				if err := session.Response.Redact(endpoint, redactor); err != nil {
+					return false, fmt.Errorf("failed redacting %s: %w", path, err)
+				}
+			}
+		}
+		for _, frame := range session.Frames {
+			payload, err := frame.Data()
+			if err != nil {
+				return false, fmt.Errorf("failed parsing %s: %w", path, err)
+			}
+			frame.SetData(redactor.Bytes(payload))
+			frame.CloseReason = redactor.String(frame.CloseReason)
+		}
+	}
+	redacted, err := recording.Marshal()
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(buf, redacted) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	return true, os.WriteFile(path, redacted, 0644)
+}
+
+func loadGRPCRecording(path string) (*grpcRecording, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := store.ParseGRPCRecording(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	return &grpcRecording{path: path, original: buf, recording: recording, newPath: path}, nil
+}
+
+// redactGRPCRecording redacts the calls of a gRPC recording like record mode
+// does. Messages stored as binary protobuf are kept as they are, since
+// redacting them would corrupt their encoding. Calls without Test-Name are
+// recorded in a file named after the sha sum of their request, which is
+// renamed after the redacted request.
+func redactGRPCRecording(cfg *config.TestServerConfig, rec *grpcRecording, redactor *redact.Redact) error {
+	name := strings.TrimSuffix(filepath.Base(rec.path), ".grpc.json")
+	var named *store.RecordedRequest
+	if len(rec.recording.Calls) > 0 && rec.recording.RecordID == name {
+		named = rec.recording.Calls[0].Request
+		if named.Headers["Test-Name"] != "" || named.ComputeSum() != name {
+			named = nil
+		}
+	}
+	for _, call := range rec.recording.Calls {
+		endpoint := cfg.FindEndpoint(call.Request.ServerAddress, call.Request.Port)
+		if endpoint == nil {
+			endpoint = &config.EndpointConfig{}
+		}
+		if err := call.Request.Redact(endpoint, redactor); err != nil {
+			return err
+		}
+		if err := call.Redact(endpoint, redactor); err != nil {
+			return err
+		}
+	}
+	if named != nil {
+		rec.recording.RecordID = named.ComputeSum()
+		rec.newPath = filepath.Join(filepath.Dir(rec.path), rec.recording.RecordID+".grpc.json")
+	}
+	return nil
+}
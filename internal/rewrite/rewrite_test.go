@@ -0,0 +1,352 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rewrite
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func newInteraction(url string, previousRequest string, headers map[string]string) *store.RecordInteraction {
+	request := &store.RecordedRequest{
+		Method:          "GET",
+		URL:             url,
+		Request:         "GET " + url + " HTTP/1.1",
+		Headers:         headers,
+		PreviousRequest: previousRequest,
+		ServerAddress:   "example.com",
+		Port:            443,
+		Protocol:        "https",
+	}
+	return &store.RecordInteraction{
+		Request: request,
+		SHASum:  request.ComputeSum(),
+		Response: &store.RecordedResponse{
+			StatusCode:   200,
+			BodySegments: []map[string]any{{"token": "leaked-secret"}},
+		},
+	}
+}
+
+func writeRecordFile(t *testing.T, path string, recordFile *store.RecordFile) {
+	buf, err := json.MarshalIndent(recordFile, "", "  ")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+}
+
+func readRecordFile(t *testing.T, path string) *store.RecordFile {
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var recordFile store.RecordFile
+	require.NoError(t, json.Unmarshal(buf, &recordFile))
+	return &recordFile
+}
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+
+	first := newInteraction("/v1/a?key=leaked-secret", store.HeadSHA, map[string]string{"Test-Name": "test"})
+	second := newInteraction("/v1/b?key=leaked-secret", first.SHASum, map[string]string{"Test-Name": "test"})
+	writeRecordFile(t, filepath.Join(dir, "test.json"), &store.RecordFile{
+		RecordID:     "test",
+		Interactions: []*store.RecordInteraction{first, second},
+	})
+
+	unnamed := newInteraction("/v1/c?key=leaked-secret", second.SHASum, map[string]string{})
+	unnamedPath := filepath.Join(dir, unnamed.SHASum+".json")
+	writeRecordFile(t, unnamedPath, &store.RecordFile{
+		RecordID:     unnamed.SHASum,
+		Interactions: []*store.RecordInteraction{unnamed},
+	})
+
+	wsPath := filepath.Join(dir, "test.websocket.log")
+	require.NoError(t, os.WriteFile(wsPath, []byte(">14 leaked-secret\n<3 ok\n"), 0644))
+	wsRecordingPath := filepath.Join(dir, "test.websocket.json")
+	wsRecording, err := (&store.WebsocketRecording{RecordID: "test", Sessions: []*store.WebsocketSession{{
+		Request: &store.RecordedRequest{URL: "/ws?key=leaked-secret", ServerAddress: "example.com", Port: 443},
+		Frames: []*store.WebsocketFrame{
+			store.NewWebsocketFrame(store.DirectionClient, store.OpcodeText, []byte(`{"key":"leaked-secret"}`), 0),
+			store.NewWebsocketFrame(store.DirectionServer, store.OpcodeBinary, []byte("leaked-secret"), 0),
+		},
+	}}}).Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(wsRecordingPath, wsRecording, 0644))
+
+	cfg := &config.TestServerConfig{
+		Endpoints: []config.EndpointConfig{
+			{TargetHost: "example.com", TargetPort: 443, RedactResponses: true},
+		},
+	}
+	redactor, err := redact.NewRedact([]string{"leaked-secret"})
+	require.NoError(t, err)
+
+	summary, err := Rewrite(cfg, dir, redactor, true)
+	require.NoError(t, err)
+	require.Len(t, summary.Changed, 4)
+	require.Equal(t, 3, summary.Interactions)
+	require.Equal(t, first.SHASum, readRecordFile(t, filepath.Join(dir, "test.json")).Interactions[0].SHASum, "dry run should not write files")
+
+	summary, err = Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{unnamedPath, filepath.Join(dir, "test.json"), wsRecordingPath, wsPath}, summary.Changed)
+	require.Len(t, summary.Files, 4)
+
+	recordFile := readRecordFile(t, filepath.Join(dir, "test.json"))
+	redactedFirst, redactedSecond := recordFile.Interactions[0], recordFile.Interactions[1]
+	require.Equal(t, "/v1/a?key=REDACTED", redactedFirst.Request.URL)
+	require.Equal(t, []map[string]any{{"token": "REDACTED"}}, redactedFirst.Response.BodySegments)
+	require.Equal(t, store.HeadSHA, redactedFirst.Request.PreviousRequest)
+	require.Equal(t, redactedFirst.Request.ComputeSum(), redactedFirst.SHASum)
+	require.Equal(t, redactedFirst.SHASum, redactedSecond.Request.PreviousRequest)
+	require.Equal(t, redactedSecond.Request.ComputeSum(), redactedSecond.SHASum)
+
+	renamedPath := summary.Renamed[unnamedPath]
+	require.NotEmpty(t, renamedPath)
+	require.NoFileExists(t, unnamedPath)
+	renamed := readRecordFile(t, renamedPath)
+	require.Equal(t, filepath.Base(renamedPath), renamed.RecordID+".json")
+	require.Equal(t, redactedSecond.SHASum, renamed.Interactions[0].Request.PreviousRequest)
+	require.Equal(t, renamed.Interactions[0].Request.ComputeSum(), renamed.RecordID)
+
+	ws, err := os.ReadFile(wsPath)
+	require.NoError(t, err)
+	require.Equal(t, ">9 REDACTED\n<3 ok\n", string(ws))
+
+	ws, err = os.ReadFile(wsRecordingPath)
+	require.NoError(t, err)
+	redactedRecording, err := store.ParseWebsocketRecording(ws)
+	require.NoError(t, err)
+	redactedSession := redactedRecording.Sessions[0]
+	require.Equal(t, "/ws?key=REDACTED", redactedSession.Request.URL)
+	require.Equal(t, `{"key":"REDACTED"}`, string(redactedSession.Frames[0].Payload))
+	payload, err := redactedSession.Frames[1].Data()
+	require.NoError(t, err)
+	require.Equal(t, "REDACTED", string(payload))
+
+	summary, err = Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	require.Empty(t, summary.Changed, "rewriting redacted recordings should be a no-op")
+}
+
+func TestRewrite_GRPC(t *testing.T) {
+	dir := t.TempDir()
+	call := store.NewGRPCCall(&store.RecordedRequest{
+		Method:        "POST",
+		URL:           "/test.Echo/Say",
+		Headers:       map[string]string{"Authorization": "Bearer leaked-secret", "Test-Name": "test"},
+		ServerAddress: "example.com",
+		Port:          443,
+	})
+	clientMessage := store.NewGRPCMessage(store.DirectionClient, false, []byte("\n\rleaked-secret"), 0)
+	serverMessage := store.NewGRPCMessage(store.DirectionServer, false, nil, 0)
+	serverMessage.SetJSON([]byte(`{"email":"a@example.com","token":"leaked-secret"}`))
+	call.Messages = []*store.GRPCMessage{clientMessage, serverMessage}
+	call.Response = &store.RecordedResponse{StatusCode: 200, Headers: map[string]string{"Set-Cookie": "session=abc"}}
+	call.Trailers = map[string]string{"X-Token": "leaked-secret"}
+	call.Status = store.GRPCStatus{Code: 16, Message: "invalid token leaked-secret"}
+	buf, err := (&store.GRPCRecording{RecordID: "test", Calls: []*store.GRPCCall{call}}).Marshal()
+	require.NoError(t, err)
+	grpcPath := filepath.Join(dir, "test.grpc.json")
+	require.NoError(t, os.WriteFile(grpcPath, buf, 0644))
+
+	cfg := &config.TestServerConfig{
+		Endpoints: []config.EndpointConfig{{
+			TargetHost:            "example.com",
+			TargetPort:            443,
+			RedactResponseHeaders: []string{"Set-Cookie"},
+			RedactJSONPaths:       jsonpath.MustParseAll("email"),
+			RedactResponses:       true,
+		}},
+	}
+	redactor, err := redact.NewRedact([]string{"leaked-secret"})
+	require.NoError(t, err)
+
+	summary, err := Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{grpcPath}, summary.Changed)
+	require.Equal(t, []string{grpcPath}, summary.Files)
+
+	buf, err = os.ReadFile(grpcPath)
+	require.NoError(t, err)
+	recording, err := store.ParseGRPCRecording(buf)
+	require.NoError(t, err)
+	redactedCall := recording.Calls[0]
+	require.Equal(t, "Bearer REDACTED", redactedCall.Request.Headers["Authorization"])
+	require.Equal(t, `{"email":"REDACTED","token":"REDACTED"}`, string(redactedCall.Messages[1].Message))
+	data, err := redactedCall.Messages[0].Bytes()
+	require.NoError(t, err)
+	require.Equal(t, []byte("\n\rleaked-secret"), data, "binary messages should not be corrupted")
+	require.Empty(t, redactedCall.Response.Headers)
+	require.Equal(t, map[string]string{"X-Token": "REDACTED"}, redactedCall.Trailers)
+	require.Equal(t, "invalid token REDACTED", redactedCall.Status.Message)
+
+	summary, err = Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	require.Empty(t, summary.Changed, "rewriting redacted recordings should be a no-op")
+}
+
+// writeUnnamedGRPCRecording writes a gRPC recording of a call without
+// Test-Name, named after the sha sum of its request like record mode does.
+func writeUnnamedGRPCRecording(t *testing.T, dir string, authorization string) string {
+	call := store.NewGRPCCall(&store.RecordedRequest{
+		Method:        "POST",
+		URL:           "/test.Echo/Say",
+		Headers:       map[string]string{"Authorization": authorization},
+		ServerAddress: "example.com",
+		Port:          443,
+	})
+	name := call.Request.ComputeSum()
+	buf, err := (&store.GRPCRecording{RecordID: name, Calls: []*store.GRPCCall{call}}).Marshal()
+	require.NoError(t, err)
+	path := filepath.Join(dir, name+".grpc.json")
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	return path
+}
+
+func TestRewrite_RenamesGRPCRecording(t *testing.T) {
+	dir := t.TempDir()
+	path := writeUnnamedGRPCRecording(t, dir, "Bearer leaked-secret")
+	cfg := &config.TestServerConfig{
+		Endpoints: []config.EndpointConfig{{TargetHost: "example.com", TargetPort: 443}},
+	}
+	redactor, err := redact.NewRedact([]string{"leaked-secret"})
+	require.NoError(t, err)
+
+	summary, err := Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	renamedPath := summary.Renamed[path]
+	require.NotEmpty(t, renamedPath)
+	require.NoFileExists(t, path)
+	buf, err := os.ReadFile(renamedPath)
+	require.NoError(t, err)
+	recording, err := store.ParseGRPCRecording(buf)
+	require.NoError(t, err)
+	// Replay derives the same name from the redacted request.
+	request := recording.Calls[0].Request
+	require.Equal(t, "Bearer REDACTED", request.Headers["Authorization"])
+	name, err := request.GetRecordingFileName()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, name+".grpc.json"), renamedPath)
+	require.Equal(t, name, recording.RecordID)
+
+	summary, err = Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+	require.Empty(t, summary.Changed, "rewriting redacted recordings should be a no-op")
+}
+
+func TestRewrite_RenamesChainedRecording(t *testing.T) {
+	dir := t.TempDir()
+	first := newInteraction("/v1/a?key=leaked-secret", store.HeadSHA, map[string]string{"Test-Name": "test"})
+	writeRecordFile(t, filepath.Join(dir, "test.json"), &store.RecordFile{
+		RecordID:     "test",
+		Interactions: []*store.RecordInteraction{first},
+	})
+
+	// Record mode names the recording after the sum of the request chained to
+	// the previous request, then records it with store.HeadSHA as previous
+	// request.
+	unnamed := newInteraction("/v1/c?key=leaked-secret", store.HeadSHA, map[string]string{})
+	named := *unnamed.Request
+	named.PreviousRequest = first.SHASum
+	unnamedPath := filepath.Join(dir, named.ComputeSum()+".json")
+	writeRecordFile(t, unnamedPath, &store.RecordFile{
+		RecordID:     named.ComputeSum(),
+		Interactions: []*store.RecordInteraction{unnamed},
+	})
+
+	cfg := &config.TestServerConfig{
+		Endpoints: []config.EndpointConfig{{TargetHost: "example.com", TargetPort: 443}},
+	}
+	redactor, err := redact.NewRedact([]string{"leaked-secret"})
+	require.NoError(t, err)
+	summary, err := Rewrite(cfg, dir, redactor, false)
+	require.NoError(t, err)
+
+	redactedFirst := readRecordFile(t, filepath.Join(dir, "test.json")).Interactions[0]
+	renamedPath := summary.Renamed[unnamedPath]
+	require.NotEmpty(t, renamedPath)
+	renamed := readRecordFile(t, renamedPath)
+	require.Equal(t, store.HeadSHA, renamed.Interactions[0].Request.PreviousRequest)
+	require.Equal(t, renamed.Interactions[0].Request.ComputeSum(), renamed.Interactions[0].SHASum)
+	// Replay derives the same name from the redacted request chained to the
+	// redacted first request.
+	replayed := *renamed.Interactions[0].Request
+	replayed.PreviousRequest = redactedFirst.SHASum
+	name, err := replayed.GetRecordingFileName()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, name+".json"), renamedPath)
+	require.Equal(t, name, renamed.RecordID)
+}
+
+func TestRewrite_RenameCollision(t *testing.T) {
+	redactor, err := redact.NewRedact([]string{"leaked-secret", "other-secret"})
+	require.NoError(t, err)
+	cfg := &config.TestServerConfig{
+		Endpoints: []config.EndpointConfig{{TargetHost: "example.com", TargetPort: 443}},
+	}
+	writeUnnamed := func(t *testing.T, dir string, url string) string {
+		interaction := newInteraction(url, store.HeadSHA, map[string]string{})
+		path := filepath.Join(dir, interaction.SHASum+".json")
+		writeRecordFile(t, path, &store.RecordFile{
+			RecordID:     interaction.SHASum,
+			Interactions: []*store.RecordInteraction{interaction},
+		})
+		return path
+	}
+
+	t.Run("Two recordings renamed to the same path", func(t *testing.T) {
+		dir := t.TempDir()
+		first := writeUnnamed(t, dir, "/v1/a?key=leaked-secret")
+		second := writeUnnamed(t, dir, "/v1/a?key=other-secret")
+		_, err := Rewrite(cfg, dir, redactor, false)
+		require.ErrorContains(t, err, "cannot rename both")
+		require.FileExists(t, first)
+		require.FileExists(t, second)
+	})
+
+	t.Run("Recording renamed to an existing file", func(t *testing.T) {
+		dir := t.TempDir()
+		redacted := newInteraction("/v1/a?key=REDACTED", store.HeadSHA, map[string]string{})
+		existing := filepath.Join(dir, redacted.SHASum+".json")
+		require.NoError(t, os.WriteFile(existing, []byte("not a recording"), 0644))
+		leaked := writeUnnamed(t, dir, "/v1/a?key=leaked-secret")
+		_, err := Rewrite(cfg, dir, redactor, true)
+		require.ErrorContains(t, err, "already exists")
+		require.FileExists(t, leaked)
+		buf, err := os.ReadFile(existing)
+		require.NoError(t, err)
+		require.Equal(t, "not a recording", string(buf))
+	})
+
+	t.Run("gRPC recording renamed to an existing recording", func(t *testing.T) {
+		dir := t.TempDir()
+		redacted := writeUnnamedGRPCRecording(t, dir, "Bearer REDACTED")
+		leaked := writeUnnamedGRPCRecording(t, dir, "Bearer leaked-secret")
+		_, err := Rewrite(cfg, dir, redactor, false)
+		require.ErrorContains(t, err, "already exists")
+		require.FileExists(t, leaked)
+		require.FileExists(t, redacted)
+	})
+}
@@ -0,0 +1,445 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
+)
+
+// Kinds of findings reported for values the endpoint config should have redacted.
+const (
+	KindRedactRequestHeader  = "redact_request_headers"
+	KindRecordRequestHeader  = "record_request_headers"
+	KindRedactResponseHeader = "redact_response_headers"
+	KindRecordResponseHeader = "record_response_headers"
+	KindRedactQueryParam     = "redact_query_params"
+	KindRedactJSONPath       = "redact_json_paths"
+)
+
+// Finding is a suspected secret in a recording.
+type Finding struct {
+	File string
+	// Path is the JSON path of the value in the recording, or the index of the
+	// chunk for legacy websocket logs.
+	Path string
+	// Kind is the redaction rule or detector that flagged the value.
+	Kind string
+	// Preview is a masked preview of the value.
+	Preview string
+}
+
+func (f Finding) String() string {
+	if f.Preview == "" {
+		return fmt.Sprintf("%s: %s: %s", f.File, f.Path, f.Kind)
+	}
+	return fmt.Sprintf("%s: %s: %s (%s)", f.File, f.Path, f.Kind, f.Preview)
+}
+
+// Scan walks the recording directory and returns the suspected secrets found
+// in JSON recordings and websocket logs, either by the redactor or because
+// the config of the recorded endpoint would have redacted them.
+func Scan(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact) ([]Finding, error) {
+	var findings []Finding
+	err := filepath.WalkDir(recordingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		var fileFindings []Finding
+		switch {
+		case strings.HasSuffix(path, ".websocket.log"):
+			fileFindings, err = scanWebsocketLog(path, redactor)
+		case strings.HasSuffix(path, ".websocket.json"):
+			fileFindings, err = scanWebsocketRecording(path, redactor)
+		case strings.HasSuffix(path, ".grpc.json"):
+			fileFindings, err = scanGRPCRecording(cfg, path, redactor)
+		case strings.HasSuffix(path, ".json"):
+			fileFindings, err = scanJSON(cfg, path, redactor)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		findings = append(findings, fileFindings...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func scanWebsocketLog(path string, redactor *redact.Redact) ([]Finding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := store.ParseWebsocketLog(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	s := &scanner{file: path, redactor: redactor}
+	for i, chunk := range chunks {
+		s.payload(fmt.Sprintf("chunks[%d]", i), chunk[1:])
+	}
+	return s.findings, nil
+}
+
+func scanWebsocketRecording(path string, redactor *redact.Redact) ([]Finding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := store.ParseWebsocketRecording(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	s := &scanner{file: path, redactor: redactor}
+	for i, session := range recording.Sessions {
+		sessionPath := fmt.Sprintf("sessions[%d]", i)
+		if session.Request != nil {
+			s.str(joinPath(sessionPath, "request.url"), session.Request.URL)
+			s.value(joinPath(sessionPath, "request.headers"), headersValue(session.Request.Headers))
+		}
+		if session.Response != nil {
+			s.value(joinPath(sessionPath, "response.headers"), headersValue(session.Response.Headers))
+		}
+		for j, frame := range session.Frames {
+			framePath := fmt.Sprintf("%s.frames[%d]", sessionPath, j)
+			payload, err := frame.Data()
+			if err != nil {
+				return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+			}
+			s.payload(joinPath(framePath, "payload"), string(payload))
+			s.str(joinPath(framePath, "closeReason"), frame.CloseReason)
+		}
+	}
+	return s.findings, nil
+}
+
+func scanGRPCRecording(cfg *config.TestServerConfig, path string, redactor *redact.Redact) ([]Finding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := store.ParseGRPCRecording(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	s := &scanner{file: path, redactor: redactor}
+	for i, call := range recording.Calls {
+		callPath := fmt.Sprintf("calls[%d]", i)
+		s.str(joinPath(callPath, "request.url"), call.Request.URL)
+		s.value(joinPath(callPath, "request.headers"), headersValue(call.Request.Headers))
+		if call.Response != nil {
+			s.value(joinPath(callPath, "response.headers"), headersValue(call.Response.Headers))
+		}
+		s.value(joinPath(callPath, "trailers"), headersValue(call.Trailers))
+		s.str(joinPath(callPath, "status.message"), call.Status.Message)
+		for j, message := range call.Messages {
+			messagePath := fmt.Sprintf("%s.messages[%d]", callPath, j)
+			if len(message.Message) > 0 {
+				s.payload(joinPath(messagePath, "message"), string(message.Message))
+				continue
+			}
+			payload, err := message.Bytes()
+			if err != nil {
+				return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+			}
+			s.str(joinPath(messagePath, "data"), string(payload))
+		}
+
+		endpoint := cfg.FindEndpoint(call.Request.ServerAddress, call.Request.Port)
+		if endpoint == nil {
+			continue
+		}
+		s.requestRules(endpoint, joinPath(callPath, "request"), call.Request)
+		if call.Response != nil {
+			s.responseRules(endpoint, joinPath(callPath, "response"), call.Response)
+		}
+		s.headers(joinPath(callPath, "trailers"), call.Trailers, endpoint.RedactResponseHeaders, KindRedactResponseHeader)
+		if len(endpoint.RecordResponseHeaders) > 0 {
+			s.unlistedHeaders(joinPath(callPath, "trailers"), call.Trailers, endpoint.RecordResponseHeaders, KindRecordResponseHeader)
+		}
+		for j, message := range call.Messages {
+			var body map[string]any
+			if err := json.Unmarshal(message.Message, &body); err != nil {
+				continue
+			}
+			s.jsonPaths(fmt.Sprintf("%s.messages[%d].message", callPath, j), body, endpoint.RedactJSONPaths)
+		}
+	}
+	return s.findings, nil
+}
+
+func scanJSON(cfg *config.TestServerConfig, path string, redactor *redact.Redact) ([]Finding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	s := &scanner{file: path, redactor: redactor}
+	s.value("", doc)
+
+	var recordFile store.RecordFile
+	if err := json.Unmarshal(data, &recordFile); err == nil {
+		for i, interaction := range recordFile.Interactions {
+			s.interaction(cfg, fmt.Sprintf("interactions[%d]", i), interaction)
+		}
+	}
+	return s.findings, nil
+}
+
+type scanner struct {
+	file     string
+	redactor *redact.Redact
+	findings []Finding
+}
+
+func (s *scanner) add(path string, kind string, value string) {
+	s.findings = append(s.findings, Finding{File: s.file, Path: path, Kind: kind, Preview: mask(value)})
+}
+
+// payload scans a websocket payload, as JSON when it parses.
+func (s *scanner) payload(path string, payload string) {
+	var doc any
+	if err := json.Unmarshal([]byte(payload), &doc); err == nil {
+		s.value(path, doc)
+		return
+	}
+	s.str(path, payload)
+}
+
+// value scans all the strings of a decoded JSON document.
+func (s *scanner) value(path string, value any) {
+	switch v := value.(type) {
+	case string:
+		s.str(path, v)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.value(joinPath(path, key), v[key])
+		}
+	case []any:
+		for i, item := range v {
+			s.value(fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	}
+}
+
+func (s *scanner) str(path string, value string) {
+	for _, finding := range s.redactor.Find(value) {
+		s.add(path, finding.Kind, finding.Value)
+	}
+}
+
+// interaction reports the values the config of the recorded endpoint would
+// have redacted.
+func (s *scanner) interaction(cfg *config.TestServerConfig, path string, interaction *store.RecordInteraction) {
+	req := interaction.Request
+	if req == nil {
+		return
+	}
+	// Bodies recorded as base64 are only scanned decoded.
+	s.base64Body(joinPath(path, "request.bodyBase64"), req.BodyBase64)
+	if interaction.Response != nil {
+		s.base64Body(joinPath(path, "response.bodyBase64"), interaction.Response.BodyBase64)
+	}
+
+	endpoint := cfg.FindEndpoint(req.ServerAddress, req.Port)
+	if endpoint == nil {
+		return
+	}
+
+	s.requestRules(endpoint, joinPath(path, "request"), req)
+	for i, bodySegment := range req.BodySegments {
+		s.jsonPaths(fmt.Sprintf("%s[%d]", joinPath(path, "request.bodySegments"), i), bodySegment, endpoint.RedactJSONPaths)
+	}
+
+	resp := interaction.Response
+	if resp == nil {
+		return
+	}
+	s.responseRules(endpoint, joinPath(path, "response"), resp)
+	for i, bodySegment := range resp.BodySegments {
+		s.jsonPaths(fmt.Sprintf("%s[%d]", joinPath(path, "response.bodySegments"), i), bodySegment, endpoint.RedactJSONPaths)
+	}
+}
+
+// base64Body scans a body recorded as base64.
+func (s *scanner) base64Body(path string, body string) {
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return
+	}
+	s.str(path, string(data))
+}
+
+// requestRules reports the request headers and query parameters the endpoint
+// config would have redacted.
+func (s *scanner) requestRules(endpoint *config.EndpointConfig, path string, req *store.RecordedRequest) {
+	s.headers(joinPath(path, "headers"), req.Headers, endpoint.RedactRequestHeaders, KindRedactRequestHeader)
+	if len(endpoint.RecordRequestHeaders) > 0 {
+		s.unlistedHeaders(joinPath(path, "headers"), req.Headers, append([]string{"Test-Name"}, endpoint.RecordRequestHeaders...), KindRecordRequestHeader)
+	}
+	s.queryParams(joinPath(path, "url"), req.URL, endpoint.RedactQueryParams)
+}
+
+// responseRules reports the response headers and trailers the endpoint config
+// would have redacted.
+func (s *scanner) responseRules(endpoint *config.EndpointConfig, path string, resp *store.RecordedResponse) {
+	s.headers(joinPath(path, "headers"), resp.Headers, endpoint.RedactResponseHeaders, KindRedactResponseHeader)
+	s.headers(joinPath(path, "trailers"), resp.Trailers, endpoint.RedactResponseHeaders, KindRedactResponseHeader)
+	if len(endpoint.RecordResponseHeaders) > 0 {
+		s.unlistedHeaders(joinPath(path, "headers"), resp.Headers, endpoint.RecordResponseHeaders, KindRecordResponseHeader)
+		s.unlistedHeaders(joinPath(path, "trailers"), resp.Trailers, endpoint.RecordResponseHeaders, KindRecordResponseHeader)
+	}
+}
+
+func (s *scanner) headers(path string, headers map[string]string, redacted []string, kind string) {
+	for _, header := range redacted {
+		if value, ok := headers[header]; ok {
+			s.add(joinPath(path, header), kind, value)
+		}
+	}
+}
+
+func (s *scanner) unlistedHeaders(path string, headers map[string]string, allowed []string, kind string) {
+	keep := make(map[string]struct{}, len(allowed))
+	for _, header := range allowed {
+		keep[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+	names := make([]string, 0, len(headers))
+	for header := range headers {
+		names = append(names, header)
+	}
+	sort.Strings(names)
+	for _, header := range names {
+		if _, ok := keep[http.CanonicalHeaderKey(header)]; !ok {
+			s.add(joinPath(path, header), kind, headers[header])
+		}
+	}
+}
+
+func (s *scanner) queryParams(path string, rawURL string, params []string) {
+	if len(params) == 0 {
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	for _, param := range params {
+		for _, value := range query[param] {
+			if value != redact.REDACTED {
+				s.add(path, KindRedactQueryParam, value)
+			}
+		}
+	}
+}
+
+// jsonPaths reports the values of a JSON body at the paths the endpoint config
+// would have redacted.
+func (s *scanner) jsonPaths(path string, body map[string]any, paths []jsonpath.Path) {
+	for _, p := range paths {
+		p.Replace(body, func(value any) any {
+			if !isRedacted(value) {
+				s.add(fmt.Sprintf("%s.%s", path, p), KindRedactJSONPath, fmt.Sprint(value))
+			}
+			return value
+		})
+	}
+}
+
+// isRedacted reports whether value only holds the placeholders Redact.Fields
+// replaces values with.
+func isRedacted(value any) bool {
+	switch v := value.(type) {
+	case string:
+		return redact.IsPlaceholder(v)
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case map[string]any:
+		for _, item := range v {
+			if !isRedacted(item) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		for _, item := range v {
+			if !isRedacted(item) {
+				return false
+			}
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+// headersValue converts headers to a decoded JSON object, to scan them with value.
+func headersValue(headers map[string]string) map[string]any {
+	value := make(map[string]any, len(headers))
+	for name, header := range headers {
+		value[name] = header
+	}
+	return value
+}
+
+// mask returns a preview of value that does not reveal it.
+func mask(value string) string {
+	if len(value) <= 8 {
+		return strings.Repeat("*", len(value))
+	}
+	return value[:4] + strings.Repeat("*", 4)
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/spf13/afero"
+)
+
+// Resolve returns the secret values of all the given sources. Relative file
+// paths are resolved against baseDir. Unset environment variables resolve to
+// no secret, and so do missing files of optional sources.
+func Resolve(sources []config.SecretSource, baseDir string) ([]string, error) {
+	return ResolveWithFs(afero.NewOsFs(), sources, baseDir)
+}
+
+func ResolveWithFs(fs afero.Fs, sources []config.SecretSource, baseDir string) ([]string, error) {
+	var secrets []string
+	for _, source := range sources {
+		values, err := resolve(fs, source, baseDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if value != "" {
+				secrets = append(secrets, value)
+			}
+		}
+	}
+	return secrets, nil
+}
+
+// ResolveCredential returns the secret value of an upstream credential,
+// without its prefix. Unlike redaction secrets, credentials must resolve to a
+// value.
+func ResolveCredential(cred config.UpstreamCredential, baseDir string) (string, error) {
+	return ResolveCredentialWithFs(afero.NewOsFs(), cred, baseDir)
+}
+
+func ResolveCredentialWithFs(fs afero.Fs, cred config.UpstreamCredential, baseDir string) (string, error) {
+	values, err := resolve(fs, cred.Source, baseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed resolving upstream credential %s: %w", cred.Name, err)
+	}
+	for _, value := range values {
+		if value != "" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("upstream credential %s has no value", cred.Name)
+}
+
+func resolve(fs afero.Fs, source config.SecretSource, baseDir string) ([]string, error) {
+	switch {
+	case source.Env != "":
+		return []string{os.Getenv(source.Env)}, nil
+	case source.File != "":
+		buf, err := readFile(fs, source.File, baseDir, source.Optional)
+		if err != nil || buf == nil {
+			return nil, err
+		}
+		return parseLines(buf), nil
+	case source.Dotenv != "":
+		buf, err := readFile(fs, source.Dotenv, baseDir, source.Optional)
+		if err != nil || buf == nil {
+			return nil, err
+		}
+		values, err := parseDotenv(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %s: %w", source.Dotenv, err)
+		}
+		return dotenvSecrets(values, source.Keys), nil
+	default:
+		return nil, fmt.Errorf("secret source must set one of env, file or dotenv")
+	}
+}
+
+func readFile(fs afero.Fs, path string, baseDir string, optional bool) ([]byte, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	buf, err := afero.ReadFile(fs, path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed reading secrets from %s: %w", path, err)
+	}
+	return buf, nil
+}
+
+// parseLines returns the non blank lines of buf, one secret per line.
+func parseLines(buf []byte) []string {
+	var secrets []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+	return secrets
+}
+
+// dotenvSecrets returns the values of the given keys, or all values when no
+// keys are given.
+func dotenvSecrets(values map[string]string, keys []string) []string {
+	if len(keys) == 0 {
+		for key := range values {
+			keys = append(keys, key)
+		}
+		// Sorted so that numbered replacements are stable across runs.
+		sort.Strings(keys)
+	}
+	var secrets []string
+	for _, key := range keys {
+		secrets = append(secrets, values[key])
+	}
+	return secrets
+}
+
+// parseDotenv parses KEY=VALUE lines, ignoring blank lines, comments and
+// export prefixes. Values may be single or double quoted.
+func parseDotenv(buf []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing '='", lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.ReplaceAll(value[1:len(value)-1], `\n`, "\n")
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveWithFs(t *testing.T) {
+	t.Setenv("TEST_SERVER_TEST_API_KEY", "key,with,commas")
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/config/secrets.txt", []byte("first\r\n\nsecond\n"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/config/.env", []byte(`# comment
+export API_KEY=plain # trailing comment
+TOKEN="quoted value"
+OTHER='single'
+EMPTY=
+`), 0644))
+
+	testCases := []struct {
+		name     string
+		sources  []config.SecretSource
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "Environment variable",
+			sources:  []config.SecretSource{{Env: "TEST_SERVER_TEST_API_KEY"}},
+			expected: []string{"key,with,commas"},
+		},
+		{
+			name:     "Unset environment variable",
+			sources:  []config.SecretSource{{Env: "TEST_SERVER_TEST_UNSET"}},
+			expected: nil,
+		},
+		{
+			name:     "File relative to the base directory",
+			sources:  []config.SecretSource{{File: "secrets.txt"}},
+			expected: []string{"first", "second"},
+		},
+		{
+			name:     "Absolute file",
+			sources:  []config.SecretSource{{File: "/config/secrets.txt"}},
+			expected: []string{"first", "second"},
+		},
+		{
+			name:     "All dotenv values",
+			sources:  []config.SecretSource{{Dotenv: ".env"}},
+			expected: []string{"plain", "single", "quoted value"},
+		},
+		{
+			name:     "Selected dotenv keys",
+			sources:  []config.SecretSource{{Dotenv: ".env", Keys: []string{"TOKEN", "MISSING"}}},
+			expected: []string{"quoted value"},
+		},
+		{
+			name:    "Missing file",
+			sources: []config.SecretSource{{File: "missing.txt"}},
+			wantErr: true,
+		},
+		{
+			name:     "Missing optional file",
+			sources:  []config.SecretSource{{Dotenv: "missing.env", Optional: true}},
+			expected: nil,
+		},
+		{
+			name:    "Empty source",
+			sources: []config.SecretSource{{}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ResolveWithFs(fs, tc.sources, "/config")
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestParseDotenv_Errors(t *testing.T) {
+	_, err := parseDotenv([]byte("MISSING_EQUALS\n"))
+	require.Error(t, err)
+}
+
+func TestResolveCredentialWithFs(t *testing.T) {
+	t.Setenv("TEST_SERVER_TEST_API_KEY", "real-key")
+
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/config/key.txt", []byte("\nfile-key\n"), 0644))
+
+	testCases := []struct {
+		name     string
+		cred     config.UpstreamCredential
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "Environment variable",
+			cred:     config.UpstreamCredential{Name: "x-goog-api-key", Source: config.SecretSource{Env: "TEST_SERVER_TEST_API_KEY"}},
+			expected: "real-key",
+		},
+		{
+			name:     "First line of a file",
+			cred:     config.UpstreamCredential{Name: "key", Prefix: "Bearer ", Source: config.SecretSource{File: "key.txt"}},
+			expected: "file-key",
+		},
+		{
+			name:    "Unset environment variable",
+			cred:    config.UpstreamCredential{Name: "key", Source: config.SecretSource{Env: "TEST_SERVER_TEST_UNSET"}},
+			wantErr: true,
+		},
+		{
+			name:    "Missing file",
+			cred:    config.UpstreamCredential{Name: "key", Source: config.SecretSource{File: "missing.txt"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := ResolveCredentialWithFs(fs, tc.cred, "/config")
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, value)
+		})
+	}
+}
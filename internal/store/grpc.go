@@ -0,0 +1,355 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+)
+
+// Metadata of gRPC calls that is not recorded in the headers and trailers.
+const (
+	// grpcTimeoutHeader is the remaining deadline of a call, which changes on
+	// every run and is neither recorded nor matched.
+	grpcTimeoutHeader = "Grpc-Timeout"
+	grpcStatusHeader  = "Grpc-Status"
+	grpcMessageHeader = "Grpc-Message"
+)
+
+// GRPCCodeInternal is the gRPC status code of internal errors.
+const GRPCCodeInternal = 13
+
+// maxGRPCMessageSize bounds the length prefix of a gRPC message.
+const maxGRPCMessageSize = ReadBufferSize
+
+// GRPCRecording is the recording of the gRPC calls of a test, stored in
+// <fileName>.grpc.json.
+type GRPCRecording struct {
+	RecordID string      `json:"recordID"`
+	Calls    []*GRPCCall `json:"calls"`
+}
+
+// GRPCCall is a recorded gRPC call.
+type GRPCCall struct {
+	// Request holds the method of the call in its URL, for example
+	// /google.pubsub.v1.Publisher/Publish, and its metadata in its headers.
+	Request *RecordedRequest `json:"request"`
+	// Response holds the response metadata in its headers.
+	Response *RecordedResponse `json:"response,omitempty"`
+	// Messages are the messages of both directions in the order they were
+	// received in.
+	Messages []*GRPCMessage `json:"messages"`
+	Status   GRPCStatus     `json:"status"`
+	// Trailers are the trailing metadata, other than the status.
+	Trailers map[string]string `json:"trailers,omitempty"`
+}
+
+// GRPCStatus is the status a gRPC call ended with.
+type GRPCStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// GRPCMessage is a recorded length-prefixed gRPC message.
+type GRPCMessage struct {
+	Direction string `json:"direction"`
+	// Compressed is the compressed flag of the message, whose data is then
+	// compressed with the grpc-encoding of the call.
+	Compressed bool `json:"compressed,omitempty"`
+	// Message holds the message decoded as JSON, when its type is in the
+	// proto_descriptor_set of the endpoint.
+	Message json.RawMessage `json:"message,omitempty"`
+	// Data holds any other message, base64 encoded.
+	Data string `json:"data,omitempty"`
+	// OffsetMs is the time the message was received at, in milliseconds since
+	// the call was started.
+	OffsetMs int64 `json:"offsetMs"`
+}
+
+// NewGRPCRequest creates the RecordedRequest of a gRPC call, whose body is
+// recorded as messages.
+func NewGRPCRequest(req *http.Request, cfg config.EndpointConfig) *RecordedRequest {
+	header := req.Header.Clone()
+	header.Del(grpcTimeoutHeader)
+	return &RecordedRequest{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		Request:       fmt.Sprintf("%s %s %s", req.Method, req.URL.String(), req.Proto),
+		Headers:       GetHeadersMap(&header),
+		ServerAddress: cfg.TargetHost,
+		Port:          cfg.TargetPort,
+		Protocol:      cfg.TargetType,
+	}
+}
+
+// NewGRPCCall creates a call started by the given request.
+func NewGRPCCall(req *RecordedRequest) *GRPCCall {
+	return &GRPCCall{Request: req, Messages: []*GRPCMessage{}}
+}
+
+// Matches reports whether the call was started by the given request. Calls
+// are matched independently of the HTTP requests of the test, so the previous
+// request is ignored.
+func (c *GRPCCall) Matches(req *RecordedRequest) bool {
+	return GRPCCallSum(c.Request) == GRPCCallSum(req)
+}
+
+// GRPCCallSum returns the sha256 sum of the request of a gRPC call, ignoring
+// the previous request.
+func GRPCCallSum(req *RecordedRequest) string {
+	call := *req
+	call.PreviousRequest = ""
+	return call.ComputeSum()
+}
+
+// SetResponse records the status code and headers of the response, and the
+// status and trailers the call ended with. Trailers-only responses carry the
+// status in their headers.
+func (c *GRPCCall) SetResponse(statusCode int, header http.Header, trailer http.Header) {
+	header = header.Clone()
+	trailer = trailer.Clone()
+	status := trailer
+	if status.Get(grpcStatusHeader) == "" {
+		status = header
+	}
+	c.Status = GRPCStatus{Code: GRPCCodeInternal, Message: "missing grpc-status"}
+	if code, err := strconv.Atoi(status.Get(grpcStatusHeader)); err == nil {
+		c.Status = GRPCStatus{Code: code, Message: DecodeGRPCMessage(status.Get(grpcMessageHeader))}
+	}
+	for _, h := range []http.Header{header, trailer} {
+		h.Del(grpcStatusHeader)
+		h.Del(grpcMessageHeader)
+	}
+	c.Response = &RecordedResponse{StatusCode: int32(statusCode), Headers: GetHeadersMap(&header)}
+	if len(trailer) > 0 {
+		c.Trailers = GetHeadersMap(&trailer)
+	}
+}
+
+// StatusTrailers returns the trailers to end a replayed call with, including
+// its status.
+func (c *GRPCCall) StatusTrailers() http.Header {
+	trailer := http.Header{}
+	for name, value := range c.Trailers {
+		trailer.Set(name, value)
+	}
+	trailer.Set(grpcStatusHeader, strconv.Itoa(c.Status.Code))
+	if c.Status.Message != "" {
+		trailer.Set(grpcMessageHeader, EncodeGRPCMessage(c.Status.Message))
+	}
+	return trailer
+}
+
+// Redact applies the redaction configured for the endpoint to the response
+// metadata, trailers, status message and messages decoded as JSON of the call.
+// The request is redacted before the call is created, since it names the
+// recording.
+func (c *GRPCCall) Redact(cfg *config.EndpointConfig, redactor *redact.Redact) error {
+	for _, message := range c.Messages {
+		if err := message.Redact(cfg, redactor); err != nil {
+			return err
+		}
+	}
+	if cfg.RedactResponses {
+		c.Status.Message = redactor.String(c.Status.Message)
+	} else {
+		c.Status.Message = redactor.Credentials().String(c.Status.Message)
+	}
+	if c.Response != nil {
+		if err := c.Response.Redact(cfg, redactor); err != nil {
+			return err
+		}
+	}
+	if c.Trailers == nil {
+		return nil
+	}
+	trailers := &RecordedResponse{Headers: c.Trailers}
+	if err := trailers.Redact(cfg, redactor); err != nil {
+		return err
+	}
+	c.Trailers = trailers.Headers
+	return nil
+}
+
+// Redact applies the redaction configured for the endpoint to a message
+// decoded as JSON: client messages are redacted like request bodies and server
+// messages like response bodies.
+func (m *GRPCMessage) Redact(cfg *config.EndpointConfig, redactor *redact.Redact) error {
+	if len(m.Message) == 0 {
+		return nil
+	}
+	var body map[string]any
+	if err := json.Unmarshal(m.Message, &body); err != nil {
+		return fmt.Errorf("invalid gRPC message: %w", err)
+	}
+	if m.Direction == DirectionClient {
+		req := &RecordedRequest{BodySegments: []map[string]any{body}}
+		if err := req.Redact(cfg, redactor); err != nil {
+			return err
+		}
+		body = req.BodySegments[0]
+	} else {
+		resp := &RecordedResponse{BodySegments: []map[string]any{body}}
+		if err := resp.Redact(cfg, redactor); err != nil {
+			return err
+		}
+		body = resp.BodySegments[0]
+	}
+	message, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	m.Message = message
+	return nil
+}
+
+// NewGRPCMessage creates a message received offset after the call was started.
+func NewGRPCMessage(direction string, compressed bool, data []byte, offset time.Duration) *GRPCMessage {
+	return &GRPCMessage{
+		Direction:  direction,
+		Compressed: compressed,
+		Data:       base64.StdEncoding.EncodeToString(data),
+		OffsetMs:   offset.Milliseconds(),
+	}
+}
+
+// SetJSON sets the message decoded as JSON, in place of its binary data.
+func (m *GRPCMessage) SetJSON(message json.RawMessage) {
+	m.Message = message
+	m.Data = ""
+}
+
+// Bytes returns the binary message. Messages decoded as JSON have to be
+// encoded with their message type instead.
+func (m *GRPCMessage) Bytes() ([]byte, error) {
+	if len(m.Message) > 0 {
+		return nil, fmt.Errorf("the gRPC message is stored as JSON, its type is needed to encode it")
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gRPC message data: %w", err)
+	}
+	return data, nil
+}
+
+// ReadGRPCFrame reads a length-prefixed gRPC message. It returns io.EOF when
+// the stream ends between messages.
+func ReadGRPCFrame(r io.Reader) (bool, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return false, nil, fmt.Errorf("truncated gRPC message prefix")
+		}
+		return false, nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCMessageSize {
+		return false, nil, fmt.Errorf("gRPC message of %d bytes exceeds the limit of %d bytes", length, maxGRPCMessageSize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false, nil, fmt.Errorf("truncated gRPC message: %w", err)
+	}
+	return prefix[0] == 1, data, nil
+}
+
+// FormatGRPCFrame formats a length-prefixed gRPC message.
+func FormatGRPCFrame(compressed bool, data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// EncodeGRPCMessage percent-encodes a grpc-message status message.
+func EncodeGRPCMessage(message string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&buf, "%%%02X", c)
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// DecodeGRPCMessage decodes a percent-encoded grpc-message status message.
+// Invalid escapes are kept as is.
+func DecodeGRPCMessage(message string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			if c, err := strconv.ParseUint(message[i+1:i+3], 16, 8); err == nil {
+				buf.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(message[i])
+	}
+	return buf.String()
+}
+
+// ParseGRPCRecording parses a .grpc.json recording.
+func ParseGRPCRecording(data []byte) (*GRPCRecording, error) {
+	var recording GRPCRecording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return nil, err
+	}
+	for i, call := range recording.Calls {
+		if call.Request == nil {
+			return nil, fmt.Errorf("call %d has no request", i)
+		}
+		for _, message := range call.Messages {
+			// Messages are indented in the file, store them compact again.
+			if len(message.Message) > 0 {
+				var compact bytes.Buffer
+				if err := json.Compact(&compact, message.Message); err != nil {
+					return nil, fmt.Errorf("call %d: invalid gRPC message: %w", i, err)
+				}
+				message.Message = compact.Bytes()
+			}
+		}
+	}
+	return &recording, nil
+}
+
+// Marshal formats the recording as indented JSON.
+func (r *GRPCRecording) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGRPCFrame_Roundtrip(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(FormatGRPCFrame(false, []byte("hello")))
+	stream.Write(FormatGRPCFrame(true, []byte{0x1f, 0x8b}))
+	stream.Write(FormatGRPCFrame(false, nil))
+
+	compressed, data, err := ReadGRPCFrame(&stream)
+	require.NoError(t, err)
+	require.False(t, compressed)
+	require.Equal(t, []byte("hello"), data)
+
+	compressed, data, err = ReadGRPCFrame(&stream)
+	require.NoError(t, err)
+	require.True(t, compressed)
+	require.Equal(t, []byte{0x1f, 0x8b}, data)
+
+	_, data, err = ReadGRPCFrame(&stream)
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	_, _, err = ReadGRPCFrame(&stream)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReadGRPCFrame_Errors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		stream []byte
+	}{
+		{name: "Truncated prefix", stream: []byte{0, 0, 0}},
+		{name: "Truncated message", stream: []byte{0, 0, 0, 0, 5, 'a'}},
+		{name: "Too large", stream: []byte{0, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := ReadGRPCFrame(bytes.NewReader(tc.stream))
+			require.Error(t, err)
+			require.NotEqual(t, io.EOF, err)
+		})
+	}
+}
+
+func TestGRPCMessage_Encoding(t *testing.T) {
+	testCases := []struct {
+		message string
+		encoded string
+	}{
+		{message: "not found", encoded: "not found"},
+		{message: "100% done", encoded: "100%25 done"},
+		{message: "line\nbreak", encoded: "line%0Abreak"},
+		{message: "héllo", encoded: "h%C3%A9llo"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.message, func(t *testing.T) {
+			require.Equal(t, tc.encoded, EncodeGRPCMessage(tc.message))
+			require.Equal(t, tc.message, DecodeGRPCMessage(tc.encoded))
+		})
+	}
+	require.Equal(t, "50%zz %", DecodeGRPCMessage("50%zz %"), "invalid escapes should be kept")
+}
+
+func TestGRPCCall_SetResponse(t *testing.T) {
+	testCases := []struct {
+		name             string
+		header           http.Header
+		trailer          http.Header
+		expectedStatus   GRPCStatus
+		expectedHeaders  map[string]string
+		expectedTrailers map[string]string
+	}{
+		{
+			name:             "Trailers",
+			header:           http.Header{"Content-Type": {"application/grpc"}},
+			trailer:          http.Header{"Grpc-Status": {"0"}, "X-Request-Id": {"abc"}},
+			expectedStatus:   GRPCStatus{Code: 0},
+			expectedHeaders:  map[string]string{"Content-Type": "application/grpc"},
+			expectedTrailers: map[string]string{"X-Request-Id": "abc"},
+		},
+		{
+			name:            "Trailers-only",
+			header:          http.Header{"Content-Type": {"application/grpc"}, "Grpc-Status": {"5"}, "Grpc-Message": {"topic%20not%20found"}},
+			trailer:         http.Header{},
+			expectedStatus:  GRPCStatus{Code: 5, Message: "topic not found"},
+			expectedHeaders: map[string]string{"Content-Type": "application/grpc"},
+		},
+		{
+			name:            "Missing status",
+			header:          http.Header{"Content-Type": {"application/grpc"}},
+			expectedStatus:  GRPCStatus{Code: GRPCCodeInternal, Message: "missing grpc-status"},
+			expectedHeaders: map[string]string{"Content-Type": "application/grpc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			call := NewGRPCCall(&RecordedRequest{URL: "/test.Service/Method"})
+			call.SetResponse(http.StatusOK, tc.header, tc.trailer)
+			require.Equal(t, tc.expectedStatus, call.Status)
+			require.Equal(t, tc.expectedHeaders, call.Response.Headers)
+			require.Equal(t, tc.expectedTrailers, call.Trailers)
+		})
+	}
+}
+
+func TestGRPCCall_StatusTrailers(t *testing.T) {
+	call := &GRPCCall{
+		Status:   GRPCStatus{Code: 3, Message: "bad request: 100%"},
+		Trailers: map[string]string{"X-Request-Id": "abc"},
+	}
+	require.Equal(t, http.Header{
+		"Grpc-Status":  {"3"},
+		"Grpc-Message": {"bad request: 100%25"},
+		"X-Request-Id": {"abc"},
+	}, call.StatusTrailers())
+}
+
+func TestGRPCCall_Matches(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost/test.Service/Method", nil)
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	req.Header.Set("Grpc-Timeout", "10S")
+	call := NewGRPCCall(NewGRPCRequest(req, config.EndpointConfig{TargetHost: "example.com", TargetPort: 443}))
+	require.NotContains(t, call.Request.Headers, "Grpc-Timeout")
+
+	req.Header.Set("Grpc-Timeout", "9S")
+	other := NewGRPCRequest(req, config.EndpointConfig{TargetHost: "example.com", TargetPort: 443})
+	other.PreviousRequest = HeadSHA
+	require.True(t, call.Matches(other), "the deadline and previous request should be ignored")
+
+	req.Header.Set("X-Goog-Request-Params", "topic=a")
+	require.False(t, call.Matches(NewGRPCRequest(req, config.EndpointConfig{TargetHost: "example.com", TargetPort: 443})))
+}
+
+func TestGRPCRecording_Roundtrip(t *testing.T) {
+	call := NewGRPCCall(&RecordedRequest{Method: "POST", URL: "/test.Service/Method"})
+	call.Messages = append(call.Messages,
+		NewGRPCMessage(DirectionClient, false, []byte{0x0a, 0x01, 'a'}, 0),
+		NewGRPCMessage(DirectionServer, true, []byte{0x1f, 0x8b}, 0))
+	call.SetResponse(http.StatusOK, http.Header{"Content-Type": {"application/grpc"}}, http.Header{"Grpc-Status": {"0"}})
+	buf, err := (&GRPCRecording{RecordID: "test", Calls: []*GRPCCall{call}}).Marshal()
+	require.NoError(t, err)
+
+	recording, err := ParseGRPCRecording(buf)
+	require.NoError(t, err)
+	require.Equal(t, "test", recording.RecordID)
+	require.Equal(t, call, recording.Calls[0])
+	data, err := recording.Calls[0].Messages[0].Bytes()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x0a, 0x01, 'a'}, data)
+
+	_, err = ParseGRPCRecording([]byte(`{"calls": [{}]}`))
+	require.Error(t, err, "calls without a request should be rejected")
+}
+
+func TestGRPCMessage_Redact(t *testing.T) {
+	redactor, err := redact.NewRedact([]string{"secret"})
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{RedactJSONPaths: jsonpath.MustParseAll("user.email")}
+
+	client := &GRPCMessage{Direction: DirectionClient, Message: []byte(`{"key":"secret","user":{"email":"a@example.com"}}`)}
+	require.NoError(t, client.Redact(cfg, redactor))
+	require.JSONEq(t, `{"key":"REDACTED","user":{"email":"REDACTED"}}`, string(client.Message))
+
+	server := &GRPCMessage{Direction: DirectionServer, Message: []byte(`{"key":"secret","user":{"email":"a@example.com"}}`)}
+	require.NoError(t, server.Redact(cfg, redactor))
+	require.JSONEq(t, `{"key":"secret","user":{"email":"REDACTED"}}`, string(server.Message), "server messages should only be redacted with redact_responses")
+
+	cfg.RedactResponses = true
+	require.NoError(t, server.Redact(cfg, redactor))
+	require.JSONEq(t, `{"key":"REDACTED","user":{"email":"REDACTED"}}`, string(server.Message))
+
+	_, err = server.Bytes()
+	require.Error(t, err, "messages stored as JSON need their type to be encoded")
+
+	binary := NewGRPCMessage(DirectionClient, false, []byte("secret"), 0)
+	require.NoError(t, binary.Redact(cfg, redactor))
+	data, err := binary.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), data, "binary messages cannot be redacted")
+}
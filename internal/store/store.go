@@ -21,15 +21,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/protobody"
+	"github.com/google/test-server/internal/redact"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 const HeadSHA = "b4d6e60a9b97e7b98c63df9308728c5c88c0b40c398046772c63447b94608b4d"
@@ -54,6 +61,9 @@ type RecordedRequest struct {
 	Request      string            `json:"request,omitempty"`
 	Headers      map[string]string `json:"headers,omitempty"`
 	BodySegments []map[string]any  `json:"bodySegments,omitempty"`
+	// BodyBase64 holds the base64 encoded protobuf bodies that do not decode
+	// to JSON encoding back to the same bytes, in place of BodySegments.
+	BodyBase64 string `json:"bodyBase64,omitempty"`
 	// The sha256 sum of the previous request in the chain.
 	PreviousRequest string `json:"previousRequest,omitempty"`
 	ServerAddress   string `json:"serverAddress,omitempty"`
@@ -62,22 +72,36 @@ type RecordedRequest struct {
 }
 
 type RecordedResponse struct {
-	StatusCode          int32             `json:"statusCode,omitempty"`
-	Headers             map[string]string `json:"headers,omitempty"`
-	BodySegments        []map[string]any  `json:"bodySegments,omitempty"`
-	SDKResponseSegments []map[string]any  `json:"sdkResponseSegments,omitempty"`
+	StatusCode int32 `json:"statusCode,omitempty"`
+	// Status is the reason phrase of the status line, when it is not the
+	// standard one of the status code.
+	Status       string            `json:"status,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Trailers     map[string]string `json:"trailers,omitempty"`
+	BodySegments []map[string]any  `json:"bodySegments,omitempty"`
+	// BodyBase64 holds the base64 encoded protobuf bodies that do not decode
+	// to JSON encoding back to the same bytes, in place of BodySegments.
+	BodyBase64          string           `json:"bodyBase64,omitempty"`
+	SDKResponseSegments []map[string]any `json:"sdkResponseSegments,omitempty"`
 }
 
-// NewRecordedRequest creates a RecordedRequest from an http.Request.
-func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.EndpointConfig) (*RecordedRequest, error) {
+// NewRecordedRequest creates a RecordedRequest from an http.Request. Protobuf
+// bodies of the message types of codec are recorded as JSON, or base64 encoded
+// when the JSON would not encode back to the same bytes.
+func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.EndpointConfig, codec *protobody.Codec) (*RecordedRequest, error) {
 	// Read the body.
-	body, err := readBody(req)
+	body, rawBody, err := readBody(req, codec)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %w", err)
 	}
 
-	// Create the request string.
-	request := fmt.Sprintf("%s %s %s", req.Method, req.URL.String(), req.Proto)
+	// Create the request string. HTTP/2 requests are recorded as HTTP/1.1 so
+	// that they hash the same as their HTTP/1.1 equivalents.
+	proto := req.Proto
+	if req.ProtoMajor == 2 {
+		proto = "HTTP/1.1"
+	}
+	request := fmt.Sprintf("%s %s %s", req.Method, req.URL.String(), proto)
 
 	// Create a copy of the headers.
 	header := req.Header.Clone()
@@ -94,30 +118,43 @@ func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.En
 		Port:            cfg.TargetPort,
 		Protocol:        cfg.TargetType,
 	}
+	if rawBody != nil {
+		recordedRequest.BodySegments = nil
+		recordedRequest.BodyBase64 = base64.StdEncoding.EncodeToString(rawBody)
+	}
 
 	return recordedRequest, nil
 }
 
-func readBody(req *http.Request) (map[string]any, error) {
+// readBody reads the body of the request as a JSON body segment, or returns
+// the raw body of protobuf bodies that cannot be recorded as JSON.
+func readBody(req *http.Request, codec *protobody.Codec) (map[string]any, []byte, error) {
 	if req.Body == nil {
-		return map[string]any{}, nil
+		return map[string]any{}, nil, nil
 	}
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	var resultMap map[string]any
 	if string(body) == "" {
-		return resultMap, nil
+		return resultMap, nil, nil
+	}
+	if requestType, _ := codec.Types(req.URL.Path); requestType != nil && protobody.IsProtobuf(req.Header.Get("Content-Type")) {
+		req.Body = io.NopCloser(bytes.NewBuffer(body))
+		if bodySegment, ok := protoBodySegment(requestType, body); ok {
+			return bodySegment, nil, nil
+		}
+		return nil, body, nil
 	}
 	err = json.Unmarshal(body, &resultMap)
 	if err != nil {
 		log.Fatalf("Error unmarshaling JSON: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 	// Restore the request body for further use.
 	req.Body = io.NopCloser(bytes.NewBuffer(body))
-	return resultMap, nil
+	return resultMap, nil, nil
 }
 
 // ComputeSum computes the SHA256 sum of a RecordedRequest.
@@ -162,7 +199,126 @@ func (r *RecordedRequest) RedactHeaders(headers []string) {
 	}
 }
 
-func NewRecordedResponse(resp *http.Response, body []byte) (*RecordedResponse, error) {
+// KeepHeaders removes all headers but the specified ones and Test-Name from
+// the RecordedRequest. It keeps all headers when none are specified.
+func (r *RecordedRequest) KeepHeaders(headers []string) {
+	if len(headers) == 0 {
+		return
+	}
+	keepHeaders(r.Headers, append([]string{"Test-Name"}, headers...))
+}
+
+// RedactQueryParams replaces the values of the specified query parameters in
+// the URL of the RecordedRequest, regardless of their value.
+func (r *RecordedRequest) RedactQueryParams(params []string) {
+	if len(params) == 0 {
+		return
+	}
+	path, query, ok := strings.Cut(r.URL, "?")
+	if !ok {
+		return
+	}
+	names := make(map[string]struct{}, len(params))
+	for _, param := range params {
+		names[param] = struct{}{}
+	}
+
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		rawName, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if _, ok := names[name]; ok {
+			pairs[i] = rawName + "=" + redact.REDACTED
+		}
+	}
+
+	redactedURL := path + "?" + strings.Join(pairs, "&")
+	r.Request = strings.Replace(r.Request, r.URL, redactedURL, 1)
+	r.URL = redactedURL
+}
+
+// Redact applies the redaction configured for the endpoint to the RecordedRequest.
+func (r *RecordedRequest) Redact(cfg *config.EndpointConfig, redactor *redact.Redact) error {
+	// Keep only allowlisted headers, then redact headers by key
+	r.KeepHeaders(cfg.RecordRequestHeaders)
+	r.RedactHeaders(cfg.RedactRequestHeaders)
+	// Redact query parameters by name
+	r.RedactQueryParams(cfg.RedactQueryParams)
+	// Redacts secrets from header values
+	redactor.Headers(r.Headers)
+	r.Request = redactor.String(r.Request)
+	r.URL = redactor.String(r.URL)
+	r.BodySegments = redactBodySegments(r.BodySegments, cfg.RedactJSONPaths, redactor)
+	return nil
+}
+
+// RedactHeaders removes the specified headers from the RecordedResponse.
+func (r *RecordedResponse) RedactHeaders(headers []string) {
+	for _, header := range headers {
+		delete(r.Headers, header)
+		delete(r.Trailers, header)
+	}
+}
+
+// KeepHeaders removes all headers and trailers but the specified ones from the
+// RecordedResponse. It keeps all of them when none are specified.
+func (r *RecordedResponse) KeepHeaders(headers []string) {
+	keepHeaders(r.Headers, headers)
+	keepHeaders(r.Trailers, headers)
+}
+
+// Redact applies the redaction configured for the endpoint to the RecordedResponse.
+func (r *RecordedResponse) Redact(cfg *config.EndpointConfig, redactor *redact.Redact) error {
+	// Keep only allowlisted headers, then redact headers by key
+	r.KeepHeaders(cfg.RecordResponseHeaders)
+	r.RedactHeaders(cfg.RedactResponseHeaders)
+	if !cfg.RedactResponses {
+		// The upstream credentials are redacted anyway, in case the target
+		// echoes them.
+		credentials := redactor.Credentials()
+		credentials.Headers(r.Headers)
+		credentials.Headers(r.Trailers)
+		for i, bodySegment := range r.BodySegments {
+			r.BodySegments[i] = credentials.Map(redactor.Fields(bodySegment, cfg.RedactJSONPaths))
+		}
+		return nil
+	}
+	// Redacts secrets from header and trailer values
+	redactor.Headers(r.Headers)
+	redactor.Headers(r.Trailers)
+	r.BodySegments = redactBodySegments(r.BodySegments, cfg.RedactJSONPaths, redactor)
+	return nil
+}
+
+func redactBodySegments(bodySegments []map[string]any, paths []jsonpath.Path, redactor *redact.Redact) []map[string]any {
+	var redactedBodySegments []map[string]any
+	for _, bodySegment := range bodySegments {
+		bodySegment = redactor.Fields(bodySegment, paths)
+		redactedBodySegments = append(redactedBodySegments, redactor.Map(bodySegment))
+	}
+	return redactedBodySegments
+}
+
+// protoBodySegment decodes a protobuf body to a JSON body segment, when the
+// JSON encodes back to the same bytes, so that replay sends the exact body.
+func protoBodySegment(desc protoreflect.MessageDescriptor, body []byte) (map[string]any, bool) {
+	message, ok := protobody.ToExactJSON(desc, body)
+	if !ok {
+		return nil, false
+	}
+	var bodySegment map[string]any
+	if err := json.Unmarshal(message, &bodySegment); err != nil {
+		return nil, false
+	}
+	return bodySegment, true
+}
+
+// NewRecordedResponse creates a RecordedResponse from an http.Response and its
+// body. Protobuf bodies of the message types of codec are recorded as JSON.
+func NewRecordedResponse(resp *http.Response, body []byte, codec *protobody.Codec) (*RecordedResponse, error) {
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
 		if err != nil {
@@ -182,8 +338,19 @@ func NewRecordedResponse(resp *http.Response, body []byte) (*RecordedResponse, e
 
 	var bodySegments []map[string]any
 	var bodySegment map[string]any
+	var bodyBase64 string
+	var responseType protoreflect.MessageDescriptor
+	if resp.Request != nil && protobody.IsProtobuf(resp.Header.Get("Content-Type")) {
+		_, responseType = codec.Types(resp.Request.URL.Path)
+	}
 	err := json.Unmarshal(body, &bodySegment)
-	if err != nil {
+	if responseType != nil && len(body) > 0 {
+		if bodySegment, ok := protoBodySegment(responseType, body); ok {
+			bodySegments = append(bodySegments, bodySegment)
+		} else {
+			bodyBase64 = base64.StdEncoding.EncodeToString(body)
+		}
+	} else if err != nil {
 		// Attempt to process streamed response.
 		prefix := []byte("data: ")
 
@@ -220,12 +387,84 @@ func NewRecordedResponse(resp *http.Response, body []byte) (*RecordedResponse, e
 
 	recordedResponse := &RecordedResponse{
 		StatusCode:   int32(resp.StatusCode),
+		Status:       StatusText(resp),
 		Headers:      GetHeadersMap(&resp.Header),
 		BodySegments: bodySegments,
+		BodyBase64:   bodyBase64,
+	}
+	// Trailers are only known once the body was read, and declared trailers
+	// the server did not send have no value.
+	for name, values := range resp.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if recordedResponse.Trailers == nil {
+			recordedResponse.Trailers = make(map[string]string)
+		}
+		recordedResponse.Trailers[name] = strings.Join(values, ", ")
 	}
 	return recordedResponse, nil
 }
 
+// CheckProtoBody checks that a protobuf body recorded as JSON still encodes to
+// its message type, which redact_json_paths breaks when it replaces a
+// non-string field such as an int64 or an enum with a string placeholder.
+func (r *RecordedResponse) CheckProtoBody(urlPath string, codec *protobody.Codec) error {
+	if len(r.BodySegments) == 0 || !protobody.IsProtobuf(r.Headers["Content-Type"]) {
+		return nil
+	}
+	_, responseType := codec.Types(urlPath)
+	if responseType == nil {
+		return nil
+	}
+	message, err := json.Marshal(r.BodySegments[0])
+	if err != nil {
+		return err
+	}
+	if _, err := protobody.FromJSON(responseType, message); err != nil {
+		return fmt.Errorf("the redacted %s body cannot be encoded, redact_json_paths must only address its string fields: %w", responseType.FullName(), err)
+	}
+	return nil
+}
+
+// StatusText returns the reason phrase of the status line of resp, or "" when
+// it is the standard one of the status code.
+func StatusText(resp *http.Response) string {
+	text, _ := strings.CutPrefix(resp.Status, strconv.Itoa(resp.StatusCode))
+	text = strings.TrimPrefix(text, " ")
+	if text == "" || text == http.StatusText(resp.StatusCode) {
+		return ""
+	}
+	return text
+}
+
+// TrailerHeader returns the recorded trailers of the response.
+func (r *RecordedResponse) TrailerHeader() http.Header {
+	if len(r.Trailers) == 0 {
+		return nil
+	}
+	trailer := make(http.Header, len(r.Trailers))
+	for name, value := range r.Trailers {
+		trailer.Set(name, value)
+	}
+	return trailer
+}
+
+func keepHeaders(headers map[string]string, allowed []string) {
+	if len(allowed) == 0 {
+		return
+	}
+	keep := make(map[string]struct{}, len(allowed))
+	for _, header := range allowed {
+		keep[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+	for header := range headers {
+		if _, ok := keep[http.CanonicalHeaderKey(header)]; !ok {
+			delete(headers, header)
+		}
+	}
+}
+
 func GetHeadersMap(header *http.Header) map[string]string {
 	// Create a new map[string]string
 	headerMap := make(map[string]string)
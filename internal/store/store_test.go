@@ -23,6 +23,8 @@ import (
 	"testing"
 
 	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+	"github.com/google/test-server/internal/redact"
 	"github.com/stretchr/testify/require"
 )
 
@@ -150,6 +152,29 @@ func TestNewRecordedRequest(t *testing.T) {
 			},
 			expectedErr: false,
 		},
+		{
+			name: "Test with HTTP/2",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("GET", "http://example.com/test", nil)
+				req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+				return req
+			}(),
+			cfg: config.EndpointConfig{
+				TargetHost: "example.com",
+				TargetPort: 443,
+				TargetType: "https",
+			},
+			expected: &RecordedRequest{
+				Request:         "GET http://example.com/test HTTP/1.1",
+				Headers:         map[string]string{},
+				BodySegments:    []map[string]any{{}},
+				PreviousRequest: HeadSHA,
+				ServerAddress:   "example.com",
+				Port:            443,
+				Protocol:        "https",
+			},
+			expectedErr: false,
+		},
 		{
 			name: "Test with error reading body",
 			request: func() *http.Request {
@@ -168,7 +193,7 @@ func TestNewRecordedRequest(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			recordedRequest, err := NewRecordedRequest(tc.request, HeadSHA, tc.cfg)
+			recordedRequest, err := NewRecordedRequest(tc.request, HeadSHA, tc.cfg, nil)
 
 			if tc.expectedErr {
 				require.Error(t, err)
@@ -275,6 +300,282 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 	}
 }
 
+func TestRecordedRequest_KeepHeaders(t *testing.T) {
+	testCases := []struct {
+		name            string
+		headers         map[string]string
+		headersToKeep   []string
+		expectedHeaders map[string]string
+	}{
+		{
+			name: "Keep allowlisted headers and Test-Name",
+			headers: map[string]string{
+				"Content-Type":        "application/json",
+				"Cookie":              "session=abc",
+				"Test-Name":           "test",
+				"X-Goog-User-Project": "project",
+			},
+			headersToKeep: []string{"content-type"},
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+				"Test-Name":    "test",
+			},
+		},
+		{
+			name: "Keep all headers when none are allowlisted",
+			headers: map[string]string{
+				"Content-Type": "application/json",
+				"Cookie":       "session=abc",
+			},
+			headersToKeep: nil,
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+				"Cookie":       "session=abc",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := RecordedRequest{Headers: tc.headers}
+			request.KeepHeaders(tc.headersToKeep)
+			require.Equal(t, tc.expectedHeaders, request.Headers, "KeepHeaders() result mismatch")
+		})
+	}
+}
+
+func TestRecordedResponse_KeepHeaders(t *testing.T) {
+	response := RecordedResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Set-Cookie":   "session=abc",
+			"Test-Name":    "test",
+		},
+	}
+	response.KeepHeaders([]string{"Content-Type"})
+	require.Equal(t, map[string]string{"Content-Type": "application/json"}, response.Headers)
+}
+
+func TestRecordedRequest_RedactQueryParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		url             string
+		params          []string
+		expectedURL     string
+		expectedRequest string
+	}{
+		{
+			name:            "Redact single param",
+			url:             "/v1/models?key=abc&alt=sse",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models?key=REDACTED&alt=sse",
+			expectedRequest: "GET /v1/models?key=REDACTED&alt=sse HTTP/1.1",
+		},
+		{
+			name:            "Redact repeated and valueless params",
+			url:             "/v1/models?token=a&key&token=b",
+			params:          []string{"key", "token"},
+			expectedURL:     "/v1/models?token=REDACTED&key=REDACTED&token=REDACTED",
+			expectedRequest: "GET /v1/models?token=REDACTED&key=REDACTED&token=REDACTED HTTP/1.1",
+		},
+		{
+			name:            "Redact escaped param name",
+			url:             "/v1/models?api%5Fkey=abc",
+			params:          []string{"api_key"},
+			expectedURL:     "/v1/models?api%5Fkey=REDACTED",
+			expectedRequest: "GET /v1/models?api%5Fkey=REDACTED HTTP/1.1",
+		},
+		{
+			name:            "Non-existent param",
+			url:             "/v1/models?alt=sse",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models?alt=sse",
+			expectedRequest: "GET /v1/models?alt=sse HTTP/1.1",
+		},
+		{
+			name:            "No query",
+			url:             "/v1/models",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models",
+			expectedRequest: "GET /v1/models HTTP/1.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := RecordedRequest{
+				Method:  "GET",
+				URL:     tc.url,
+				Request: "GET " + tc.url + " HTTP/1.1",
+			}
+			request.RedactQueryParams(tc.params)
+			require.Equal(t, tc.expectedURL, request.URL)
+			require.Equal(t, tc.expectedRequest, request.Request)
+		})
+	}
+}
+
+func TestRecordedRequest_Redact(t *testing.T) {
+	redactor, err := redact.NewRedact([]string{"secret-key"})
+	require.NoError(t, err)
+	cfg := &config.EndpointConfig{
+		RedactRequestHeaders: []string{"Authorization"},
+		RedactJSONPaths:      jsonpath.MustParseAll("contents[*].parts[*].text"),
+	}
+	request := RecordedRequest{
+		Request: "POST /v1/models?key=secret-key HTTP/1.1",
+		URL:     "/v1/models?key=secret-key",
+		Headers: map[string]string{
+			"Authorization":  "Bearer token",
+			"X-Goog-Api-Key": "secret-key",
+		},
+		BodySegments: []map[string]any{
+			{"contents": []any{map[string]any{"parts": []any{map[string]any{"text": "hello"}}}}},
+		},
+	}
+
+	require.NoError(t, request.Redact(cfg, redactor))
+	require.Equal(t, "POST /v1/models?key=REDACTED HTTP/1.1", request.Request)
+	require.Equal(t, "/v1/models?key=REDACTED", request.URL)
+	require.Equal(t, map[string]string{"X-Goog-Api-Key": "REDACTED"}, request.Headers)
+	require.Equal(t, []map[string]any{
+		{"contents": []any{map[string]any{"parts": []any{map[string]any{"text": "REDACTED"}}}}},
+	}, request.BodySegments)
+}
+
+func TestRecordedResponse_Redact(t *testing.T) {
+	redactor, err := redact.New(redact.Options{Secrets: []string{"secret-token"}, Credentials: []string{"upstream-key"}})
+	require.NoError(t, err)
+	newResponse := func() RecordedResponse {
+		return RecordedResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"Set-Cookie": "session=abc",
+				"X-Token":    "secret-token",
+				"X-Echo":     "key=upstream-key",
+			},
+			Trailers: map[string]string{
+				"Set-Cookie":      "session=abc",
+				"X-Trailer-Token": "secret-token",
+			},
+			BodySegments: []map[string]any{
+				{"access_token": "secret-token", "email": "a@example.com", "error": "invalid key upstream-key"},
+			},
+		}
+	}
+
+	response := newResponse()
+	cfg := &config.EndpointConfig{
+		RedactResponseHeaders: []string{"Set-Cookie"},
+		RedactJSONPaths:       jsonpath.MustParseAll("email"),
+	}
+	require.NoError(t, response.Redact(cfg, redactor))
+	// Only the upstream credentials are redacted without redact_responses.
+	require.Equal(t, map[string]string{"X-Token": "secret-token", "X-Echo": "key=REDACTED"}, response.Headers)
+	require.Equal(t, map[string]string{"X-Trailer-Token": "secret-token"}, response.Trailers)
+	require.Equal(t, []map[string]any{
+		{"access_token": "secret-token", "email": "REDACTED", "error": "invalid key REDACTED"},
+	}, response.BodySegments)
+
+	response = newResponse()
+	cfg.RedactResponses = true
+	require.NoError(t, response.Redact(cfg, redactor))
+	require.Equal(t, map[string]string{"X-Token": "REDACTED", "X-Echo": "key=REDACTED"}, response.Headers)
+	require.Equal(t, map[string]string{"X-Trailer-Token": "REDACTED"}, response.Trailers)
+	require.Equal(t, []map[string]any{
+		{"access_token": "REDACTED", "email": "REDACTED", "error": "invalid key REDACTED"},
+	}, response.BodySegments)
+}
+
+func TestNewRecordedResponse_StatusAndTrailers(t *testing.T) {
+	testCases := []struct {
+		name             string
+		status           string
+		statusCode       int
+		trailer          http.Header
+		expectedStatus   string
+		expectedTrailers map[string]string
+	}{
+		{
+			name:       "Standard status text",
+			status:     "200 OK",
+			statusCode: 200,
+		},
+		{
+			name:           "Custom status text",
+			status:         "429 Slow Down",
+			statusCode:     429,
+			expectedStatus: "Slow Down",
+		},
+		{
+			name:       "Empty status text",
+			status:     "204",
+			statusCode: 204,
+		},
+		{
+			name:             "Trailers",
+			status:           "200 OK",
+			statusCode:       200,
+			trailer:          http.Header{"X-Checksum": {"abc"}, "X-Declared": nil},
+			expectedTrailers: map[string]string{"X-Checksum": "abc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Status: tc.status, StatusCode: tc.statusCode, Header: http.Header{}, Trailer: tc.trailer}
+			recordedResponse, err := NewRecordedResponse(resp, []byte(`{"a":1}`), nil)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedStatus, recordedResponse.Status)
+			require.Equal(t, tc.expectedTrailers, recordedResponse.Trailers)
+		})
+	}
+}
+
+func TestRecordedResponse_RedactHeaders(t *testing.T) {
+	testCases := []struct {
+		name            string
+		response        RecordedResponse
+		headersToRedact []string
+		expectedHeaders map[string]string
+	}{
+		{
+			name: "Redact single header",
+			response: RecordedResponse{
+				StatusCode: 200,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+					"Set-Cookie":   "session=abc",
+				},
+			},
+			headersToRedact: []string{"Set-Cookie"},
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+		},
+		{
+			name: "Redact non-existent header",
+			response: RecordedResponse{
+				StatusCode: 200,
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
+			},
+			headersToRedact: []string{"Non-Existent"},
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.response.RedactHeaders(tc.headersToRedact)
+			require.Equal(t, tc.expectedHeaders, tc.response.Headers, "RedactHeaders() result mismatch")
+		})
+	}
+}
+
 func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 	testCases := []struct {
 		name        string
@@ -0,0 +1,306 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// Directions of websocket frames.
+const (
+	// DirectionClient is a frame sent by the client to the server.
+	DirectionClient = "client"
+	// DirectionServer is a frame sent by the server to the client.
+	DirectionServer = "server"
+)
+
+// Opcodes of websocket frames.
+const (
+	OpcodeText   = "text"
+	OpcodeBinary = "binary"
+	OpcodeClose  = "close"
+	OpcodePing   = "ping"
+	OpcodePong   = "pong"
+)
+
+// WebsocketRecording is the structured recording of the websocket connections
+// of a test, stored in <fileName>.websocket.json.
+type WebsocketRecording struct {
+	RecordID string              `json:"recordID"`
+	Sessions []*WebsocketSession `json:"sessions"`
+}
+
+// WebsocketSession is a recorded websocket connection.
+type WebsocketSession struct {
+	// Request is the handshake request that opened the connection. Legacy
+	// recordings have no handshake request and match any handshake.
+	Request *RecordedRequest `json:"request,omitempty"`
+	// Response is the handshake response of the server.
+	Response *RecordedResponse `json:"response,omitempty"`
+	Frames   []*WebsocketFrame `json:"frames"`
+}
+
+// upgraderHeaders are the handshake response headers the websocket upgrader
+// sets itself.
+var upgraderHeaders = map[string]bool{
+	"Connection":               true,
+	"Upgrade":                  true,
+	"Content-Length":           true,
+	"Transfer-Encoding":        true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+}
+
+// UpgradeResponseHeader returns the handshake response headers to send to the
+// client with the upgrade, and the subprotocol to negotiate, from the recorded
+// or upstream handshake response headers.
+func UpgradeResponseHeader(headers map[string]string) (http.Header, string) {
+	header := http.Header{}
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if !upgraderHeaders[name] {
+			header.Set(name, value)
+		}
+	}
+	return header, headers["Sec-Websocket-Protocol"]
+}
+
+// websocketKeyHeader is the random nonce of websocket handshakes, which is
+// neither recorded nor matched.
+const websocketKeyHeader = "Sec-Websocket-Key"
+
+// NewWebsocketSession creates a session opened by the given handshake request.
+func NewWebsocketSession(req *RecordedRequest) *WebsocketSession {
+	handshake := *req
+	handshake.Headers = make(map[string]string, len(req.Headers))
+	for name, value := range req.Headers {
+		if name != websocketKeyHeader {
+			handshake.Headers[name] = value
+		}
+	}
+	return &WebsocketSession{Request: &handshake}
+}
+
+// HandshakeSum returns the sha256 sum of a websocket handshake request. Unlike
+// ComputeSum it ignores the previous request, since connections are matched
+// independently of the HTTP requests of the test, and the random
+// Sec-Websocket-Key header.
+func HandshakeSum(req *RecordedRequest) string {
+	handshake := *NewWebsocketSession(req).Request
+	handshake.PreviousRequest = ""
+	return handshake.ComputeSum()
+}
+
+// Matches reports whether the session was opened by the given handshake request.
+func (s *WebsocketSession) Matches(req *RecordedRequest) bool {
+	return s.Request == nil || HandshakeSum(s.Request) == HandshakeSum(req)
+}
+
+// WebsocketFrame is a recorded websocket frame.
+type WebsocketFrame struct {
+	Direction string `json:"direction"`
+	Opcode    string `json:"opcode"`
+	// Payload holds the payload when it is JSON, so that it is readable in the
+	// recording.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// PayloadText holds the exact text of JSON payloads that are not compact,
+	// such as the default output of Python's json.dumps, which Payload only
+	// holds compact.
+	PayloadText string `json:"payloadText,omitempty"`
+	// PayloadBase64 holds any other payload.
+	PayloadBase64 string `json:"payloadBase64,omitempty"`
+	// OffsetMs is the time the frame was received at, in milliseconds since the
+	// connection was opened.
+	OffsetMs int64 `json:"offsetMs"`
+	// CloseCode and CloseReason are the status of close frames. A reserved
+	// code, such as 1006 when the connection dropped, records that the
+	// connection ended without a close frame carrying a status.
+	CloseCode   int    `json:"closeCode,omitempty"`
+	CloseReason string `json:"closeReason,omitempty"`
+}
+
+// NewWebsocketFrame creates a frame with the given payload, received offset
+// after the connection was opened.
+func NewWebsocketFrame(direction string, opcode string, payload []byte, offset time.Duration) *WebsocketFrame {
+	frame := &WebsocketFrame{
+		Direction: direction,
+		Opcode:    opcode,
+		OffsetMs:  offset.Milliseconds(),
+	}
+	frame.SetData(payload)
+	return frame
+}
+
+// SetData sets the payload of the frame, as JSON when it is JSON and base64
+// otherwise, so that Data returns the exact same bytes.
+func (f *WebsocketFrame) SetData(payload []byte) {
+	f.Payload = nil
+	f.PayloadText = ""
+	f.PayloadBase64 = ""
+	if len(payload) == 0 {
+		return
+	}
+	var compact bytes.Buffer
+	if json.Valid(payload) && json.Compact(&compact, payload) == nil {
+		f.Payload = json.RawMessage(compact.Bytes())
+		if !bytes.Equal(compact.Bytes(), payload) {
+			f.PayloadText = string(payload)
+		}
+		return
+	}
+	f.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+}
+
+// Data returns the payload of the frame.
+func (f *WebsocketFrame) Data() ([]byte, error) {
+	if f.PayloadText != "" {
+		return []byte(f.PayloadText), nil
+	}
+	if len(f.Payload) > 0 {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, f.Payload); err != nil {
+			return nil, fmt.Errorf("invalid websocket frame payload: %w", err)
+		}
+		return compact.Bytes(), nil
+	}
+	if f.PayloadBase64 == "" {
+		return []byte{}, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(f.PayloadBase64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket frame payload: %w", err)
+	}
+	return payload, nil
+}
+
+// ParseWebsocketRecording parses a .websocket.json recording.
+func ParseWebsocketRecording(data []byte) (*WebsocketRecording, error) {
+	var recording WebsocketRecording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		return nil, err
+	}
+	for i, session := range recording.Sessions {
+		for j, frame := range session.Frames {
+			// Payloads are indented in the file, store them compact again.
+			payload, err := frame.Data()
+			if err != nil {
+				return nil, fmt.Errorf("session %d frame %d: %w", i, j, err)
+			}
+			frame.SetData(payload)
+		}
+	}
+	return &recording, nil
+}
+
+// Marshal formats the recording as indented JSON, without escaping HTML
+// characters so that JSON payloads are stored as they were sent.
+func (r *WebsocketRecording) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WebsocketFramesFromLog converts the chunks of a legacy .websocket.log
+// recording, as returned by ParseWebsocketLog, into frames. The legacy format
+// has no opcodes and timing, all frames are binary and received at once.
+func WebsocketFramesFromLog(chunks []string) []*WebsocketFrame {
+	frames := make([]*WebsocketFrame, 0, len(chunks))
+	for _, chunk := range chunks {
+		direction := DirectionClient
+		if chunk[0] == '<' {
+			direction = DirectionServer
+		}
+		frames = append(frames, NewWebsocketFrame(direction, OpcodeBinary, []byte(chunk[1:]), 0))
+	}
+	return frames
+}
+
+func extractNumber(i *int, content string) (int, error) {
+	numStart := *i
+	for *i < len(content) && unicode.IsDigit(rune(content[*i])) {
+		*i++
+	}
+	numEnd := *i
+	if numStart == numEnd {
+		return 0, fmt.Errorf("missing chunk length after prefix at position %d", numStart-1)
+	}
+	numStr := content[numStart:numEnd]
+	num, err := strconv.Atoi(numStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk length '%s': %w", numStr, err)
+	}
+	return num, nil
+}
+
+// ParseWebsocketLog parses a legacy .websocket.log recording into its chunks. Each
+// chunk is prefixed with '>' when sent by the client and '<' when sent by the
+// server.
+func ParseWebsocketLog(data []byte) ([]string, error) {
+	var chunks = make([]string, 0)
+	i := 0
+	response := string(data)
+	for i < len(response) {
+		// Extracts prefix
+		prefix := response[i]
+		if prefix != '>' && prefix != '<' {
+			return nil, fmt.Errorf("invalid message prefix at position %d: expected '>' or '<', got '%c'", i, prefix)
+		}
+		i++ // Move cursor past prefix.
+
+		// Extracts chunk length number
+		num, err := extractNumber(&i, response)
+		i++ // Move cursor to skip the whitespace between the number and the actual chunk.
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract number %v", err)
+		}
+
+		// Extracts chunk
+		chunkStart := i
+		chunkEnd := chunkStart + num
+		if chunkEnd > len(response) {
+			return nil, fmt.Errorf("chunk length %d at position %d exceeds response bounds", chunkEnd, chunkStart)
+		}
+		chunk := response[chunkStart : chunkEnd-1] // Remove the \n appended at the end of the chunk
+		chunks = append(chunks, string(prefix)+chunk)
+		i = chunkEnd
+	}
+	return chunks, nil
+}
+
+// FormatWebsocketLog formats chunks, as returned by ParseWebsocketLog, into a
+// .websocket.log recording.
+func FormatWebsocketLog(chunks []string) []byte {
+	var buf []byte
+	for _, chunk := range chunks {
+		payload := chunk[1:] + "\n"
+		buf = append(buf, fmt.Sprintf("%c%d %s", chunk[0], len(payload), payload)...)
+	}
+	return buf
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketRecording_Roundtrip(t *testing.T) {
+	testCases := []struct {
+		name           string
+		payload        []byte
+		expectedJSON   string
+		expectedText   string
+		expectedBase64 string
+	}{
+		{
+			name:         "Compact JSON",
+			payload:      []byte(`{"text":"<b>hi</b> & bye","n":1.50}`),
+			expectedJSON: `{"text":"<b>hi</b> & bye","n":1.50}`,
+		},
+		{
+			name:         "JSON with spaces",
+			payload:      []byte(`{"setup": {"model": "x"}}`),
+			expectedJSON: `{"setup":{"model":"x"}}`,
+			expectedText: `{"setup": {"model": "x"}}`,
+		},
+		{
+			name:         "Indented JSON",
+			payload:      []byte("{\n  \"a\": 1\n}"),
+			expectedJSON: `{"a":1}`,
+			expectedText: "{\n  \"a\": 1\n}",
+		},
+		{
+			name:           "Text",
+			payload:        []byte("hello"),
+			expectedBase64: "aGVsbG8=",
+		},
+		{
+			name:           "Binary",
+			payload:        []byte{0x00, 0xff, 0x10},
+			expectedBase64: "AP8Q",
+		},
+		{
+			name:    "Empty",
+			payload: []byte{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := NewWebsocketFrame(DirectionServer, OpcodeText, tc.payload, 1500*time.Millisecond)
+			require.Equal(t, tc.expectedJSON, string(frame.Payload))
+			require.Equal(t, tc.expectedText, frame.PayloadText)
+			require.Equal(t, tc.expectedBase64, frame.PayloadBase64)
+			require.Equal(t, int64(1500), frame.OffsetMs)
+
+			buf, err := (&WebsocketRecording{RecordID: "test", Sessions: []*WebsocketSession{{Frames: []*WebsocketFrame{frame}}}}).Marshal()
+			require.NoError(t, err)
+			recording, err := ParseWebsocketRecording(buf)
+			require.NoError(t, err)
+			require.Equal(t, "test", recording.RecordID)
+			require.Len(t, recording.Sessions, 1)
+			require.Len(t, recording.Sessions[0].Frames, 1)
+			payload, err := recording.Sessions[0].Frames[0].Data()
+			require.NoError(t, err)
+			require.Equal(t, tc.payload, payload)
+		})
+	}
+}
+
+func TestParseWebsocketRecording_Errors(t *testing.T) {
+	_, err := ParseWebsocketRecording([]byte(`{"sessions":[{"frames":[{"direction":"server","opcode":"binary","payloadBase64":"!"}]}]}`))
+	require.Error(t, err)
+	_, err = ParseWebsocketRecording([]byte(`not json`))
+	require.Error(t, err)
+}
+
+func TestWebsocketFramesFromLog(t *testing.T) {
+	chunks, err := ParseWebsocketLog([]byte(">8 {\"a\":1}\n<6 hello\n"))
+	require.NoError(t, err)
+	frames := WebsocketFramesFromLog(chunks)
+	require.Equal(t, []*WebsocketFrame{
+		{Direction: DirectionClient, Opcode: OpcodeBinary, Payload: []byte(`{"a":1}`)},
+		{Direction: DirectionServer, Opcode: OpcodeBinary, PayloadBase64: "aGVsbG8="},
+	}, frames)
+}
+
+func TestWebsocketSession_Matches(t *testing.T) {
+	handshake := &RecordedRequest{
+		Method:          "GET",
+		URL:             "/ws",
+		Headers:         map[string]string{"Sec-Websocket-Key": "first", "Test-Name": "test"},
+		PreviousRequest: HeadSHA,
+	}
+	session := NewWebsocketSession(handshake)
+	require.Equal(t, map[string]string{"Test-Name": "test"}, session.Request.Headers)
+	require.Equal(t, "first", handshake.Headers["Sec-Websocket-Key"], "the handshake request should not be modified")
+
+	testCases := []struct {
+		name     string
+		req      *RecordedRequest
+		expected bool
+	}{
+		{
+			name:     "Different key and previous request",
+			req:      &RecordedRequest{Method: "GET", URL: "/ws", Headers: map[string]string{"Sec-Websocket-Key": "second", "Test-Name": "test"}, PreviousRequest: "other"},
+			expected: true,
+		},
+		{
+			name:     "Different URL",
+			req:      &RecordedRequest{Method: "GET", URL: "/ws?session=2", Headers: map[string]string{"Test-Name": "test"}},
+			expected: false,
+		},
+		{
+			name:     "Different header",
+			req:      &RecordedRequest{Method: "GET", URL: "/ws", Headers: map[string]string{"Test-Name": "other"}},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, session.Matches(tc.req))
+			require.True(t, (&WebsocketSession{}).Matches(tc.req), "sessions without handshake should match any request")
+		})
+	}
+}
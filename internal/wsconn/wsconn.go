@@ -0,0 +1,129 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package wsconn holds the websocket connection handling shared by record and
+// replay mode.
+package wsconn
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// IdleCloseReason is the reason of the close frame sent to idle connections.
+const IdleCloseReason = "idle timeout"
+
+// controlTimeout is the write deadline of control frames.
+const controlTimeout = time.Second
+
+// IdleWatchdog closes websocket connections that have no activity for a
+// timeout. A nil IdleWatchdog never times out.
+type IdleWatchdog struct {
+	timeout  time.Duration
+	conns    []*websocket.Conn
+	last     atomic.Int64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewIdleWatchdog starts watching the given connections, or returns nil when
+// timeout is zero.
+func NewIdleWatchdog(timeout time.Duration, conns ...*websocket.Conn) *IdleWatchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &IdleWatchdog{
+		timeout: timeout,
+		conns:   conns,
+		stop:    make(chan struct{}),
+	}
+	w.Touch()
+	go w.watch()
+	return w
+}
+
+// Touch records activity on the connections.
+func (w *IdleWatchdog) Touch() {
+	if w == nil {
+		return
+	}
+	w.last.Store(time.Now().UnixNano())
+}
+
+// Stop stops watching the connections.
+func (w *IdleWatchdog) Stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *IdleWatchdog) watch() {
+	interval := w.timeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, w.last.Load())) < w.timeout {
+				continue
+			}
+			fmt.Printf("Closing websocket idle for %s\n", w.timeout)
+			for _, conn := range w.conns {
+				// Closing the connection unblocks its readers and writers.
+				Close(conn, websocket.CloseGoingAway, IdleCloseReason)
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// IsReservedCloseCode reports whether code only reports how a connection ended
+// and must not be sent in a close frame: 1005 for a close frame without
+// status, 1006 for a connection closed without close frame and 1015 for a
+// failed TLS handshake.
+func IsReservedCloseCode(code int) bool {
+	switch code {
+	case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		return true
+	}
+	return false
+}
+
+// Close sends a close frame. It can be called concurrently with the other
+// writes to the connection. Reserved codes are refused.
+func Close(conn *websocket.Conn, code int, reason string) error {
+	if IsReservedCloseCode(code) {
+		return fmt.Errorf("close code %d is reserved and cannot be sent", code)
+	}
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(controlTimeout))
+}
+
+// WriteControl sends a ping or pong frame. It can be called concurrently with
+// the other writes to the connection.
+func WriteControl(conn *websocket.Conn, messageType int, data string) error {
+	return conn.WriteControl(messageType, []byte(data), time.Now().Add(controlTimeout))
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wsconn
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// connPair returns the server and client side of a websocket connection.
+func connPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+// readErr reads from conn in the background and returns the error ending the
+// reads.
+func readErr(conn *websocket.Conn) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+// requireIdleClose checks that the connection was closed for being idle.
+func requireIdleClose(t *testing.T, err error) {
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.Equal(t, IdleCloseReason, closeErr.Text)
+}
+
+func TestNewIdleWatchdog_NoTimeout(t *testing.T) {
+	conn, _ := connPair(t)
+	w := NewIdleWatchdog(0, conn)
+	require.Nil(t, w)
+	// A nil watchdog can still be used.
+	w.Touch()
+	w.Stop()
+}
+
+func TestIdleWatchdog_ClosesIdleConnections(t *testing.T) {
+	conn, client := connPair(t)
+	errs := readErr(client)
+	w := NewIdleWatchdog(50*time.Millisecond, conn)
+	defer w.Stop()
+
+	select {
+	case err := <-errs:
+		requireIdleClose(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection was not closed")
+	}
+}
+
+func TestIdleWatchdog_TouchResetsTimeout(t *testing.T) {
+	conn, client := connPair(t)
+	errs := readErr(client)
+	timeout := 100 * time.Millisecond
+	w := NewIdleWatchdog(timeout, conn)
+	defer w.Stop()
+
+	// Activity more frequent than the timeout keeps the connection open.
+	for range 10 {
+		time.Sleep(timeout / 4)
+		w.Touch()
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("the active connection was closed: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-errs:
+		requireIdleClose(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed once idle")
+	}
+}
+
+func TestIdleWatchdog_Stop(t *testing.T) {
+	conn, client := connPair(t)
+	timeout := 20 * time.Millisecond
+	w := NewIdleWatchdog(timeout, conn)
+	w.Stop()
+	w.Stop()
+
+	// The stopped watchdog leaves the connection open past the timeout.
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(10*timeout)))
+	_, _, err := client.ReadMessage()
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), "expected a read timeout, got %v", err)
+}
+
+func TestClose(t *testing.T) {
+	conn, client := connPair(t)
+	require.NoError(t, Close(conn, websocket.CloseNormalClosure, "done"))
+	// Closing again does not send another close frame.
+	require.ErrorIs(t, Close(conn, websocket.CloseNormalClosure, "again"), websocket.ErrCloseSent)
+
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseNormalClosure, closeErr.Code)
+	require.Equal(t, "done", closeErr.Text)
+}
+
+func TestClose_ReservedCode(t *testing.T) {
+	conn, client := connPair(t)
+	for _, code := range []int{websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake} {
+		require.True(t, IsReservedCloseCode(code))
+		require.ErrorContains(t, Close(conn, code, ""), "reserved")
+	}
+	require.False(t, IsReservedCloseCode(websocket.CloseNormalClosure))
+
+	// No close frame was sent, so the connection can still be closed.
+	require.NoError(t, Close(conn, websocket.CloseNormalClosure, "done"))
+	_, _, err := client.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "expected a normal close, got %v", err)
+}